@@ -5,6 +5,7 @@ go 1.23.3
 require (
 	github.com/apache/openwhisk-client-go v0.0.0-20241028140229-bb8408824b9b
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/net v0.32.0
 )
 
 require (
@@ -19,7 +20,6 @@ require (
 	github.com/nxadm/tail v1.4.11 // indirect
 	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
-	golang.org/x/net v0.32.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -22,95 +22,94 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-
-	"github.com/apache/openserverless-streaming-proxy/tcp"
 )
 
-func ActionStreamHandler(streamingProxyAddr string, apihost string) func(http.ResponseWriter, *http.Request) {
+func ActionStreamHandler(cfg *Config) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx, done := context.WithCancel(context.Background())
-
 		namespace, actionToInvoke := getNamespaceAndAction(r)
 
 		log.Println(fmt.Sprintf("Private Action request: %s (%s)", actionToInvoke, namespace))
 
+		if refuseWhileDraining(w, cfg) {
+			return
+		}
+
 		apiKey, err := extractAuthToken(r)
 		if err != nil {
 			log.Println(err.Error())
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			done()
+			return
+		}
+
+		format, err := negotiateFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+
+		policy, err := getPolicy(r, cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// Create OpenWhisk client
-		client := NewOpenWhiskClient(apihost, apiKey, namespace)
+		client := NewOpenWhiskClient(cfg.ApiHost, apiKey, namespace)
 
-		// opens a socket for listening in a random port
-		sock, err := tcp.SetupTcpServer(ctx, streamingProxyAddr)
+		// opens a session the action connects to on the shared socket
+		sess, err := cfg.Sessions.Open(context.Background())
 		if err != nil {
 			log.Println(err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			done()
 			return
 		}
+		sess.Replay.SetPolicy(policy)
 
-		enrichedBody, err := injectHostPortInBody(r, sock.Host, sock.Port)
+		coords, err := getStreamCoordinates(r, cfg, sess)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			done()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			sess.Close()
 			return
 		}
 
-		// invoke the action
-		res, httpResp, err := client.Actions.Invoke(actionToInvoke, enrichedBody, false, false)
+		enrichedBody, err := decodeRequestParams(r)
+		r.Body.Close()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			done()
+			http.Error(w, err.Error(), paramsErrorStatus(err))
+			sess.Close()
 			return
 		}
-
-		if httpResp.StatusCode != http.StatusAccepted {
-			http.Error(w, "Error invoking action: "+httpResp.Status, http.StatusInternalServerError)
-			done()
+		if err := injectStreamParams(enrichedBody, cfg, coords); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			sess.Close()
 			return
 		}
 
-		if m, ok := res.(map[string]interface{}); ok {
-			log.Println("Action invoked:", m["activationId"])
-		} else {
-			http.Error(w, "Unexpected reply from action invocation", http.StatusInternalServerError)
-			done()
+		// the result of the action closes the stream, the activation is
+		// watched with a client of its own
+		watcher := newActivationWatcher(NewOpenWhiskClient(cfg.ApiHost, apiKey, namespace), r.URL.Query().Get("logs") == "true")
+		sess.SetResult(watcher.result)
+
+		// invoke the action
+		activationId, err := invokeAction(client, actionToInvoke, enrichedBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			sess.Close()
 			return
 		}
+		log.Println("Action invoked:", activationId)
+
+		meta := newStreamMeta(namespace, actionToInvoke, sess)
+		meta.ActivationID = activationId
+		openStream(sess, meta)
+		go watcher.watch(sess, activationId)
 
-		// Flush the headers
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-			done()
+		if r.URL.Query().Get("detached") == "true" {
+			respondDetached(w, sess, activationId)
 			return
 		}
 
-		for {
-			select {
-			case data := <-sock.StreamDataChan:
-				if string(data) == "EOF" {
-					log.Println("EOF received, closing connection")
-					done()
-					return
-				}
-				_, err := w.Write([]byte("data: " + string(data) + "\n\n"))
-				if err != nil {
-					log.Println("Error writing to HTTP response:", err)
-					done()
-					return
-				}
-				flusher.Flush()
-			case <-r.Context().Done():
-				log.Println("HTTP Client closed connection")
-				done()
-				return
-			}
-		}
+		setStreamTokens(w, sess)
+		relayStream(w, r, cfg, sess, format, 0, nil)
 	}
 }
@@ -0,0 +1,252 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/apache/openwhisk-client-go/whisk"
+	"github.com/stretchr/testify/require"
+)
+
+// playAction plays the invoked action, sending the given messages once it
+// is invoked.
+func playAction(ow *fakeOpenWhisk, cfg *Config, messages ...stream.Message) {
+	go func() {
+		params := <-ow.invoked
+		sess, ok := cfg.Sessions.Get(params["STREAM_SESSION"].(string))
+		if !ok {
+			return
+		}
+		for _, msg := range messages {
+			if sess.Send(msg) != nil {
+				return
+			}
+		}
+	}()
+}
+
+func postAction(t *testing.T, cfg *Config, accept string) *http.Response {
+	router := http.NewServeMux()
+	router.HandleFunc("POST /action/{ns}/{action}", ActionStreamHandler(cfg))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest("POST", server.URL+"/action/ns1/hello", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer user:pass")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestActionStreamHandlerFormats(t *testing.T) {
+	tests := []struct {
+		name           string
+		accept         string
+		format         streamFormat
+		expectedType   string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Server-Sent Events",
+			format:         formatSSE,
+			expectedType:   "text/event-stream",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "id: 2\ndata: hello\ndata: world\n\nevent: result\nid: 3\ndata: {\"activationId\":\"a1b2c3\",\"status\":\"success\",\"success\":true,\"duration\":42,\"result\":{\"answer\":42}}\n\nevent: end\nid: 4\ndata: {}\n\n",
+		},
+		{
+			name:           "NDJSON",
+			accept:         "application/x-ndjson",
+			format:         formatNDJSON,
+			expectedType:   "application/x-ndjson",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "{\"id\":\"2\",\"data\":\"hello\\nworld\"}\n{\"event\":\"result\",\"id\":\"3\",\"data\":\"{\\\"activationId\\\":\\\"a1b2c3\\\",\\\"status\\\":\\\"success\\\",\\\"success\\\":true,\\\"duration\\\":42,\\\"result\\\":{\\\"answer\\\":42}}\"}\n{\"event\":\"end\",\"id\":\"4\",\"data\":\"{}\"}\n",
+		},
+		{
+			name:           "Raw",
+			accept:         "application/octet-stream",
+			format:         formatRaw,
+			expectedType:   "application/octet-stream",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "hello\nworld",
+		},
+		{
+			name:           "Not acceptable",
+			accept:         "*/*;q=0",
+			expectedType:   "text/plain; charset=utf-8",
+			expectedStatus: http.StatusNotAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ow := newFakeOpenWhisk(t)
+			cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+			playAction(ow, cfg, stream.Message{Data: "hello\nworld"}, stream.EndMessage(stream.Trailer{}))
+
+			resp := postAction(t, cfg, tt.accept)
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedType, resp.Header.Get("Content-Type"))
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			require.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+			require.Equal(t, "no", resp.Header.Get("X-Accel-Buffering"))
+			session := resp.Header.Get("X-Stream-Session")
+			require.NotEmpty(t, session)
+			sess, _ := cfg.Sessions.Get(session)
+			require.Equal(t, sess.ReadToken, resp.Header.Get("X-Stream-Read-Token"))
+			require.Equal(t, sess.InputToken, resp.Header.Get("X-Stream-Input-Token"))
+
+			// the stream opens with the meta event
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, metaEvent(tt.format, session)+tt.expectedBody, string(body))
+		})
+	}
+}
+
+func TestActionStreamHandlerDetached(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+	server := newStreamServer(t, cfg)
+
+	// the action streams while no client is attached
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		params := <-ow.invoked
+		sess, _ := cfg.Sessions.Get(params["STREAM_SESSION"].(string))
+		sess.Send(stream.Message{Data: "report"})
+		sess.Send(stream.EndMessage(stream.Trailer{Status: "success"}))
+	}()
+
+	req, err := http.NewRequest("POST", server.URL+"/action/ns1/hello?detached=true", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer user:pass")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var reply detachedReply
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reply))
+	require.Equal(t, "a1b2c3", reply.ActivationID)
+	require.Equal(t, "/stream/"+reply.Session, resp.Header.Get("Location"))
+	require.NotEmpty(t, reply.InputToken)
+	require.Equal(t, reply.InputToken, resp.Header.Get("X-Stream-Input-Token"))
+	require.NotEmpty(t, reply.ReadToken)
+	require.Equal(t, reply.ReadToken, resp.Header.Get("X-Stream-Read-Token"))
+	<-done
+
+	// a client attaches later with the read token and gets the whole
+	// stream, but not the token to send input
+	resp = getStream(t, server, reply.Session, reply.ReadToken, "")
+	require.Empty(t, resp.Header.Get("X-Stream-Input-Token"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, metaEvent(formatNDJSON, reply.Session)+"{\"id\":\"2\",\"data\":\"report\"}\n{\"event\":\"result\",\"id\":\"3\",\"data\":\"{\\\"activationId\\\":\\\"a1b2c3\\\",\\\"status\\\":\\\"success\\\",\\\"success\\\":true,\\\"duration\\\":42,\\\"result\\\":{\\\"answer\\\":42}}\"}\n{\"event\":\"end\",\"id\":\"4\",\"data\":\"{\\\"status\\\":\\\"success\\\"}\"}\n", string(body))
+}
+
+func TestActionStreamHandlerDraining(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	draining := make(chan struct{})
+	close(draining)
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), Draining: draining}
+
+	// the streamer shutting down refuses new invocations
+	resp := postAction(t, cfg, "")
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get("Retry-After"))
+	require.Equal(t, 0, cfg.Sessions.Len())
+}
+
+func TestActionStreamHandlerFailedActivation(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	ow.activation = &whisk.Activation{
+		ActivationID: "a1b2c3",
+		Duration:     60000,
+		Response:     whisk.Response{Status: "action developer error", Result: map[string]interface{}{"error": "The action exceeded its time limits of 60000 milliseconds."}},
+	}
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+
+	// the action times out without connecting, the stream ends with its error
+	resp := postAction(t, cfg, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, metaEvent(formatSSE, resp.Header.Get("X-Stream-Session"))+"event: error\nid: 2\ndata: {\"activationId\":\"a1b2c3\",\"status\":\"action developer error\",\"success\":false,\"duration\":60000,\"result\":{\"error\":\"The action exceeded its time limits of 60000 milliseconds.\"}}\n\n", string(body))
+}
+
+func TestActionStreamHandlerBody(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+	server := newStreamServer(t, cfg)
+
+	post := func(contentType, body string) *http.Response {
+		req, err := http.NewRequest("POST", server.URL+"/action/ns1/hello?detached=true", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer user:pass")
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// a form is turned into parameters
+	require.Equal(t, http.StatusAccepted, post("application/x-www-form-urlencoded", "name=ada").StatusCode)
+	params := <-ow.invoked
+	require.Equal(t, "ada", params["name"])
+	require.NotEmpty(t, params["STREAM_SESSION"])
+	coords := params["__ow_stream"].(map[string]interface{})
+	require.Equal(t, params["STREAM_SESSION"], coords["session"])
+	require.Equal(t, "8282", coords["port"])
+	require.Equal(t, stream.ProtocolVersion, coords["version"])
+
+	// and a text is the body parameter
+	require.Equal(t, http.StatusAccepted, post("text/plain", "hello").StatusCode)
+	require.Equal(t, "hello", (<-ow.invoked)["__ow_body"])
+
+	require.Equal(t, http.StatusBadRequest, post("application/json", "{").StatusCode)
+	require.Equal(t, http.StatusUnsupportedMediaType, post("multipart/mixed; boundary=x", "--x--").StatusCode)
+
+	// the stream coordinates cannot be given by the client
+	require.Equal(t, http.StatusBadRequest, post("application/json", `{"__ow_stream":{"session":"s1"}}`).StatusCode)
+	require.Equal(t, http.StatusBadRequest, post("application/x-www-form-urlencoded", "STREAM_TOKEN=secret").StatusCode)
+
+	// the sessions of the rejected requests are closed
+	require.Eventually(t, func() bool {
+		return cfg.Sessions.Len() == 2
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,184 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxBodySize is the largest request body turned into action parameters,
+// the default payload limit of OpenWhisk.
+const maxBodySize = 1 << 20
+
+// owBody is the parameter carrying a body that is not made of parameters,
+// as for the OpenWhisk web actions.
+const owBody = "__ow_body"
+
+var errUnsupportedMediaType = errors.New("Unsupported media type")
+
+// decodeRequestParams reads the action parameters from the body of the
+// request, the way OpenWhisk does for web actions:
+//
+//   - a JSON object, or no body, gives the parameters;
+//   - a form, urlencoded or multipart, gives a parameter for each field,
+//     an uploaded file being an object with its filename, content type and
+//     base64 data;
+//   - any other body is the __ow_body parameter: a JSON value as it is, a
+//     text as a string and anything else as a base64 string.
+//
+// The body is JSON when the request has no content type.
+func decodeRequestParams(r *http.Request) (map[string]interface{}, error) {
+	mediaType, mediaParams := "application/json", map[string]string{}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		mediaType, mediaParams, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errUnsupportedMediaType, contentType)
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return decodeJSONParams(body)
+	case mediaType == "application/x-www-form-urlencoded":
+		return decodeFormParams(body)
+	case mediaType == "multipart/form-data":
+		return decodeMultipartParams(body, mediaParams["boundary"])
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return nil, fmt.Errorf("%w: %s", errUnsupportedMediaType, mediaType)
+	case isText(mediaType):
+		return map[string]interface{}{owBody: string(body)}, nil
+	default:
+		return map[string]interface{}{owBody: base64.StdEncoding.EncodeToString(body)}, nil
+	}
+}
+
+// paramsErrorStatus is the status of the reply to a request whose
+// parameters could not be read.
+func paramsErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func decodeJSONParams(body []byte) (map[string]interface{}, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return make(map[string]interface{}), nil
+	}
+	if body[0] == '{' {
+		return decodeParams(bytes.NewReader(body))
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{owBody: value}, nil
+}
+
+func decodeFormParams(body []byte) (map[string]interface{}, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	params := make(map[string]interface{})
+	for name, fieldValues := range values {
+		for _, value := range fieldValues {
+			addParam(params, name, value)
+		}
+	}
+	return params, nil
+}
+
+func decodeMultipartParams(body []byte, boundary string) (map[string]interface{}, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart body without boundary")
+	}
+
+	params := make(map[string]interface{})
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return params, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if part.FileName() == "" {
+			addParam(params, name, string(data))
+			continue
+		}
+		addParam(params, name, map[string]interface{}{
+			"filename":    part.FileName(),
+			"contentType": part.Header.Get("Content-Type"),
+			"data":        base64.StdEncoding.EncodeToString(data),
+		})
+	}
+}
+
+// addParam sets a parameter, a field repeated in a form becoming an array.
+func addParam(params map[string]interface{}, name string, value interface{}) {
+	switch previous := params[name].(type) {
+	case nil:
+		params[name] = value
+	case []interface{}:
+		params[name] = append(previous, value)
+	default:
+		params[name] = []interface{}{previous, value}
+	}
+}
+
+func isText(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/xml" ||
+		strings.HasSuffix(mediaType, "+xml")
+}
@@ -0,0 +1,162 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func multipartBody(t *testing.T) (string, string) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	require.NoError(t, writer.WriteField("title", "report"))
+	require.NoError(t, writer.WriteField("tag", "a"))
+	require.NoError(t, writer.WriteField("tag", "b"))
+	file, err := writer.CreateFormFile("upload", "hello.txt")
+	require.NoError(t, err)
+	file.Write([]byte("hello"))
+	require.NoError(t, writer.Close())
+	return writer.FormDataContentType(), buf.String()
+}
+
+func TestDecodeRequestParams(t *testing.T) {
+	multipartType, multipartContent := multipartBody(t)
+
+	tests := []struct {
+		name           string
+		contentType    string
+		body           string
+		expected       map[string]interface{}
+		expectedStatus int
+	}{
+		{
+			name:     "JSON object without content type",
+			body:     `{"key": "value"}`,
+			expected: map[string]interface{}{"key": "value"},
+		},
+		{
+			name:        "JSON object",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"key": "value"}`,
+			expected:    map[string]interface{}{"key": "value"},
+		},
+		{
+			name:     "no body",
+			expected: map[string]interface{}{},
+		},
+		{
+			name:        "JSON array",
+			contentType: "application/json",
+			body:        `[1, 2]`,
+			expected:    map[string]interface{}{"__ow_body": []interface{}{1.0, 2.0}},
+		},
+		{
+			name:           "invalid JSON",
+			contentType:    "application/json",
+			body:           `{"key": `,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "urlencoded form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "name=ada&lang=go&lang=c",
+			expected:    map[string]interface{}{"name": "ada", "lang": []interface{}{"go", "c"}},
+		},
+		{
+			name:           "invalid urlencoded form",
+			contentType:    "application/x-www-form-urlencoded",
+			body:           "name=%zz",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "multipart form",
+			contentType: multipartType,
+			body:        multipartContent,
+			expected: map[string]interface{}{
+				"title": "report",
+				"tag":   []interface{}{"a", "b"},
+				"upload": map[string]interface{}{
+					"filename":    "hello.txt",
+					"contentType": "application/octet-stream",
+					"data":        "aGVsbG8=",
+				},
+			},
+		},
+		{
+			name:           "multipart form without boundary",
+			contentType:    "multipart/form-data",
+			body:           multipartContent,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "other multipart",
+			contentType:    "multipart/mixed; boundary=x",
+			body:           "--x--",
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "invalid content type",
+			contentType:    "text/",
+			body:           "hello",
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "text",
+			contentType: "text/plain",
+			body:        "hello world",
+			expected:    map[string]interface{}{"__ow_body": "hello world"},
+		},
+		{
+			name:        "binary",
+			contentType: "image/png",
+			body:        "\x89PNG",
+			expected:    map[string]interface{}{"__ow_body": "iVBORw=="},
+		},
+		{
+			name:           "too large",
+			contentType:    "text/plain",
+			body:           strings.Repeat("a", maxBodySize+1),
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/action/ns1/hello", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			params, err := decodeRequestParams(r)
+			if tt.expectedStatus != 0 {
+				require.Error(t, err)
+				require.Equal(t, tt.expectedStatus, paramsErrorStatus(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, params)
+		})
+	}
+}
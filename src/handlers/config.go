@@ -0,0 +1,76 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+)
+
+// DefaultHeartbeat is how long a stream stays silent by default before a
+// heartbeat is sent to the client.
+const DefaultHeartbeat = 15 * time.Second
+
+// DefaultWebHeaders are the headers of the clients forwarded by default to
+// the web actions.
+var DefaultWebHeaders = []string{
+	"Accept-Language",
+	"Authorization",
+	"Cookie",
+	"Referer",
+	"User-Agent",
+	"X-Forwarded-For",
+	"X-Require-Whisk-Auth",
+}
+
+// DefaultStreamParam is the parameter carrying the stream coordinates to
+// the actions by default.
+const DefaultStreamParam = "__ow_stream"
+
+// ShutdownRetry is how long the clients are told to wait before
+// reconnecting when the streamer shuts down.
+const ShutdownRetry = 5 * time.Second
+
+// Config holds the settings shared by the stream handlers.
+type Config struct {
+	// ApiHost is the OpenWhisk API host.
+	ApiHost string
+	// Sessions routes the action output to the waiting handlers.
+	Sessions *stream.Registry
+	// StreamHost and StreamPort are the address of the TCP ingress
+	// given to the actions.
+	StreamHost string
+	StreamPort string
+	// StreamURL is the base URL of the HTTP ingress given to the actions.
+	StreamURL string
+	// StreamParam is the parameter carrying the stream coordinates to the
+	// actions, DefaultStreamParam when empty.
+	StreamParam string
+	// OmitLegacyParams leaves out the STREAM_* parameters, which carry the
+	// stream coordinates too for the actions written before StreamParam.
+	OmitLegacyParams bool
+	// WebHeaders are the headers of the clients forwarded to the web actions.
+	WebHeaders []string
+	// Heartbeat is how long a stream stays silent before a heartbeat is
+	// sent to the client, 0 for no heartbeat.
+	Heartbeat time.Duration
+	// Draining is closed when the streamer shuts down: the new invocations
+	// are refused and the clients are told to reconnect later.
+	Draining <-chan struct{}
+}
@@ -0,0 +1,152 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+)
+
+// streamFormat is how the messages of a stream are written to the client.
+// The formats with a heartbeat can keep a silent stream alive without
+// altering it, and the formats with a reconnect hint can tell the client
+// when to reconnect after the streamer shut down.
+type streamFormat struct {
+	contentType string
+	write       func(w io.Writer, msg stream.Message) error
+	heartbeat   func(w io.Writer) error
+	reconnect   func(w io.Writer, retry time.Duration) error
+}
+
+var (
+	formatSSE    = streamFormat{"text/event-stream", writeSSE, writeSSEKeepalive, writeSSERetry}
+	formatNDJSON = streamFormat{"application/x-ndjson", writeNDJSON, nil, writeNDJSONReconnect}
+	formatRaw    = streamFormat{"application/octet-stream", writeRaw, nil, nil}
+)
+
+// formats are the formats of a stream, in order of preference when the
+// Accept header does not prefer one.
+var formats = []streamFormat{formatSSE, formatNDJSON, formatRaw}
+
+var errNotAcceptable = errors.New("Not acceptable, the stream is available as text/event-stream, application/x-ndjson or application/octet-stream")
+
+// negotiateFormat chooses the format preferred by the Accept header of the
+// request. Each format takes the quality of the most specific media range
+// matching it, so that text/event-stream;q=0 refuses Server-Sent Events
+// even with */*. Server-Sent Events, or the first format not refused, are
+// chosen when no media range matches, as the clients asking for e.g.
+// application/json get the stream anyway.
+func negotiateFormat(r *http.Request) (streamFormat, error) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatSSE, nil
+	}
+
+	qualities := make([]float64, len(formats))
+	specificities := make([]int, len(formats))
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		for i, format := range formats {
+			specificity := matchMediaRange(mediaType, format.contentType)
+			if specificity > specificities[i] || specificity > 0 && specificity == specificities[i] && q > qualities[i] {
+				qualities[i], specificities[i] = q, specificity
+			}
+		}
+	}
+
+	best := -1
+	for i := range formats {
+		if qualities[i] > 0 && (best < 0 || qualities[i] > qualities[best]) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return formats[best], nil
+	}
+	for i, format := range formats {
+		if specificities[i] == 0 {
+			return format, nil
+		}
+	}
+	return streamFormat{}, errNotAcceptable
+}
+
+// matchMediaRange tells how specifically the media range matches the media
+// type: 3 for the type itself, 2 for type/*, 1 for */*, and 0 when it does
+// not match.
+func matchMediaRange(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 3
+	case mediaRange == "*/*":
+		return 1
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 2
+	}
+	return 0
+}
+
+// startStream sets the headers of a streamed response, so that neither the
+// client nor a proxy buffers it.
+func startStream(w http.ResponseWriter, format streamFormat) {
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+}
+
+// writeNDJSON writes a message as a JSON line.
+func writeNDJSON(w io.Writer, msg stream.Message) error {
+	_, err := w.Write(append(stream.EncodeMessage(msg), '\n'))
+	return err
+}
+
+// writeNDJSONReconnect writes a "reconnect" event, outside of the stream,
+// with the delay before reconnecting.
+func writeNDJSONReconnect(w io.Writer, retry time.Duration) error {
+	return writeNDJSON(w, stream.Message{Event: "reconnect", Retry: int(retry.Milliseconds())})
+}
+
+// streamerEvents are the events added by the streamer around and within the
+// output of the action.
+var streamerEvents = map[string]bool{"meta": true, "result": true, "dropped": true}
+
+// writeRaw writes the data of a message as it is. The end of stream only
+// closes the response, and the events of the streamer are left out.
+func writeRaw(w io.Writer, msg stream.Message) error {
+	if msg.End || streamerEvents[msg.Event] {
+		return nil
+	}
+	_, err := io.WriteString(w, msg.Data)
+	return err
+}
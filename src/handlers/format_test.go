@@ -0,0 +1,182 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		expected    string
+		expectedErr bool
+	}{
+		{
+			name:     "No Accept header",
+			expected: "text/event-stream",
+		},
+		{
+			name:     "Any",
+			accept:   "*/*",
+			expected: "text/event-stream",
+		},
+		{
+			name:     "EventSource",
+			accept:   "text/event-stream",
+			expected: "text/event-stream",
+		},
+		{
+			name:     "NDJSON",
+			accept:   "application/x-ndjson",
+			expected: "application/x-ndjson",
+		},
+		{
+			name:     "Raw",
+			accept:   "application/octet-stream",
+			expected: "application/octet-stream",
+		},
+		{
+			name:     "Quality values",
+			accept:   "text/event-stream;q=0.5, application/x-ndjson, */*;q=0.1",
+			expected: "application/x-ndjson",
+		},
+		{
+			name:     "Unsupported types are ignored",
+			accept:   "text/html, application/xhtml+xml, */*;q=0.8",
+			expected: "text/event-stream",
+		},
+		{
+			name:     "Any application type",
+			accept:   "application/*",
+			expected: "application/x-ndjson",
+		},
+		{
+			name:     "No match",
+			accept:   "application/json",
+			expected: "text/event-stream",
+		},
+		{
+			name:     "Text",
+			accept:   "text/plain",
+			expected: "text/event-stream",
+		},
+		{
+			name:     "Refused",
+			accept:   "text/event-stream;q=0",
+			expected: "application/x-ndjson",
+		},
+		{
+			name:     "Refused over a wildcard",
+			accept:   "text/event-stream;q=0, */*",
+			expected: "application/x-ndjson",
+		},
+		{
+			name:     "Refused over a type wildcard",
+			accept:   "application/*;q=0.5, application/x-ndjson;q=0",
+			expected: "application/octet-stream",
+		},
+		{
+			name:        "Not acceptable",
+			accept:      "*/*;q=0",
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			format, err := negotiateFormat(req)
+			if tt.expectedErr {
+				require.ErrorIs(t, err, errNotAcceptable)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, format.contentType)
+		})
+	}
+}
+
+func TestStartStream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	startStream(rec, formatNDJSON)
+
+	require.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	require.Equal(t, "no-cache", rec.Header().Get("Cache-Control"))
+	require.Equal(t, "no", rec.Header().Get("X-Accel-Buffering"))
+}
+
+func TestWriteFormats(t *testing.T) {
+	messages := []stream.Message{
+		{Event: "token", Data: "hello"},
+		{Data: "world"},
+		stream.EndMessage(stream.Trailer{Status: "success"}),
+	}
+
+	tests := []struct {
+		name     string
+		format   streamFormat
+		messages []stream.Message
+		expected string
+	}{
+		{
+			name:     "NDJSON",
+			format:   formatNDJSON,
+			expected: "{\"event\":\"token\",\"data\":\"hello\"}\n{\"data\":\"world\"}\n{\"event\":\"end\",\"data\":\"{\\\"status\\\":\\\"success\\\"}\"}\n",
+		},
+		{
+			name:     "Raw",
+			format:   formatRaw,
+			expected: "helloworld",
+		},
+		{
+			name:   "Raw with dropped messages",
+			format: formatRaw,
+			messages: []stream.Message{
+				{Data: "a"},
+				stream.DroppedMessage(stream.Dropped{Count: 2}),
+				{Data: "b"},
+				stream.DroppedMessage(stream.Dropped{Disconnected: true}),
+			},
+			expected: "ab",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if tt.messages == nil {
+				tt.messages = messages
+			}
+			for _, msg := range tt.messages {
+				require.NoError(t, tt.format.write(&buf, msg))
+			}
+			require.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
@@ -20,22 +20,130 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
 )
 
-func injectHostPortInBody(r *http.Request, tcpServerHost string, tcpServerPort string) (map[string]interface{}, error) {
-	body := r.Body
-	defer body.Close()
+// streamCoordinates tell the action where and how to write its stream,
+// either on the TCP socket at Host and Port or to the HTTP or WebSocket
+// ingress at URL.
+type streamCoordinates struct {
+	Host    string
+	Port    string
+	URL     string
+	Session string
+	Token   string
+}
+
+// getStreamCoordinates returns the coordinates of the ingress requested
+// with the X-Stream-Ingress header, the TCP socket by default.
+func getStreamCoordinates(r *http.Request, cfg *Config, sess *stream.Session) (streamCoordinates, error) {
+	coords := streamCoordinates{Session: sess.ID, Token: sess.Token}
+
+	switch ingress := r.Header.Get("X-Stream-Ingress"); ingress {
+	case "", "tcp":
+		coords.Host = cfg.StreamHost
+		coords.Port = cfg.StreamPort
+	case "http":
+		coords.URL = cfg.StreamURL + "/ingest/" + sess.ID
+	case "ws":
+		coords.URL = webSocketURL(cfg.StreamURL) + "/ingest/" + sess.ID
+	default:
+		return coords, fmt.Errorf("Unsupported stream ingress %q", ingress)
+	}
+	return coords, nil
+}
+
+// webSocketURL turns an http(s) URL into the matching ws(s) one.
+func webSocketURL(httpURL string) string {
+	if rest, ok := strings.CutPrefix(httpURL, "https://"); ok {
+		return "wss://" + rest
+	}
+	return "ws://" + strings.TrimPrefix(httpURL, "http://")
+}
 
-	jsonBody := make(map[string]interface{})
-	if err := json.NewDecoder(body).Decode(&jsonBody); err != nil {
+// decodeParams reads the action parameters, a JSON object, from the body.
+func decodeParams(body io.Reader) (map[string]interface{}, error) {
+	params := make(map[string]interface{})
+	if err := json.NewDecoder(body).Decode(&params); err != nil {
 		return nil, err
 	}
+	return params, nil
+}
+
+// legacyStreamParams are the parameters carrying the stream coordinates
+// before they were gathered in a single one.
+var legacyStreamParams = []string{"STREAM_HOST", "STREAM_PORT", "STREAM_URL", "STREAM_SESSION", "STREAM_TOKEN"}
+
+// streamParams is the parameter carrying the stream coordinates to the
+// actions.
+type streamParams struct {
+	Host    string `json:"host,omitempty"`
+	Port    string `json:"port,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Session string `json:"session"`
+	Token   string `json:"token"`
+	Version string `json:"version"`
+}
 
-	jsonBody["STREAM_HOST"] = tcpServerHost
-	jsonBody["STREAM_PORT"] = tcpServerPort
-	return jsonBody, nil
+// streamParamName returns the parameter carrying the stream coordinates.
+func streamParamName(cfg *Config) string {
+	if cfg.StreamParam != "" {
+		return cfg.StreamParam
+	}
+	return DefaultStreamParam
+}
+
+// reservedParam tells whether a parameter is set by the streamer, so that
+// the clients cannot give it.
+func reservedParam(cfg *Config, name string) bool {
+	return name == streamParamName(cfg) || slices.Contains(legacyStreamParams, name)
+}
+
+// checkReservedParams refuses the parameters set by the streamer.
+func checkReservedParams(cfg *Config, params map[string]interface{}) error {
+	for name := range params {
+		if reservedParam(cfg, name) {
+			return fmt.Errorf("The parameter %s is reserved", name)
+		}
+	}
+	return nil
+}
+
+// injectStreamParams adds the stream coordinates to the action parameters,
+// after checking the client did not give them.
+func injectStreamParams(params map[string]interface{}, cfg *Config, coords streamCoordinates) error {
+	if err := checkReservedParams(cfg, params); err != nil {
+		return err
+	}
+
+	params[streamParamName(cfg)] = streamParams{
+		Host:    coords.Host,
+		Port:    coords.Port,
+		URL:     coords.URL,
+		Session: coords.Session,
+		Token:   coords.Token,
+		Version: stream.ProtocolVersion,
+	}
+	if cfg.OmitLegacyParams {
+		return nil
+	}
+
+	if coords.URL != "" {
+		params["STREAM_URL"] = coords.URL
+	} else {
+		params["STREAM_HOST"] = coords.Host
+		params["STREAM_PORT"] = coords.Port
+	}
+	params["STREAM_SESSION"] = coords.Session
+	params["STREAM_TOKEN"] = coords.Token
+	return nil
 }
 
 func getNamespaceAndAction(r *http.Request) (string, string) {
@@ -61,3 +169,26 @@ func extractAuthToken(r *http.Request) (string, error) {
 	apiKey = strings.TrimPrefix(apiKey, "Bearer ")
 	return apiKey, nil
 }
+
+// getPolicy returns the slow client policy asked with the policy query
+// parameter, or the default one.
+func getPolicy(r *http.Request, cfg *Config) (stream.Policy, error) {
+	name := r.URL.Query().Get("policy")
+	if name == "" {
+		return cfg.Sessions.Policy, nil
+	}
+	return stream.ParsePolicy(name)
+}
+
+// refuseWhileDraining replies 503 to the invocations arriving while the
+// streamer shuts down, and reports whether it did.
+func refuseWhileDraining(w http.ResponseWriter, cfg *Config) bool {
+	select {
+	case <-cfg.Draining:
+		w.Header().Set("Retry-After", strconv.Itoa(int(ShutdownRetry.Seconds())))
+		http.Error(w, "The streamer is shutting down", http.StatusServiceUnavailable)
+		return true
+	default:
+		return false
+	}
+}
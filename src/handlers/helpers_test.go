@@ -22,43 +22,32 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/apache/openserverless-streaming-proxy/stream"
 	"github.com/stretchr/testify/require"
 )
 
-func TestInjectHostPortInBody(t *testing.T) {
+func TestDecodeParams(t *testing.T) {
 	tests := []struct {
 		name           string
 		body           string
-		tcpServerHost  string
-		tcpServerPort  string
 		expectedBody   map[string]interface{}
 		expectedErrMsg string
 	}{
 		{
-			name:          "Valid JSON body",
-			body:          `{"key": "value"}`,
-			tcpServerHost: "localhost",
-			tcpServerPort: "8080",
-			expectedBody: map[string]interface{}{
-				"key":         "value",
-				"STREAM_HOST": "localhost",
-				"STREAM_PORT": "8080",
-			},
+			name:           "Valid JSON body",
+			body:           `{"key": "value"}`,
+			expectedBody:   map[string]interface{}{"key": "value"},
 			expectedErrMsg: "",
 		},
 		{
 			name:           "Empty JSON body",
 			body:           `{}`,
-			tcpServerHost:  "localhost",
-			tcpServerPort:  "8080",
-			expectedBody:   map[string]interface{}{"STREAM_HOST": "localhost", "STREAM_PORT": "8080"},
+			expectedBody:   map[string]interface{}{},
 			expectedErrMsg: "",
 		},
 		{
 			name:           "Invalid JSON body",
 			body:           `{"key": "value"`,
-			tcpServerHost:  "localhost",
-			tcpServerPort:  "8080",
 			expectedBody:   nil,
 			expectedErrMsg: "unexpected EOF",
 		},
@@ -66,10 +55,7 @@ func TestInjectHostPortInBody(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req, err := http.NewRequest("POST", "/", bytes.NewBufferString(tt.body))
-			require.NoError(t, err)
-
-			actualBody, err := injectHostPortInBody(req, tt.tcpServerHost, tt.tcpServerPort)
+			actualBody, err := decodeParams(bytes.NewBufferString(tt.body))
 			if tt.expectedErrMsg != "" {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), tt.expectedErrMsg)
@@ -84,6 +70,80 @@ func TestInjectHostPortInBody(t *testing.T) {
 	}
 }
 
+func TestInjectStreamParams(t *testing.T) {
+	tcp := streamCoordinates{Host: "localhost", Port: "8080", Session: "s1", Token: "secret"}
+	tests := []struct {
+		name           string
+		cfg            Config
+		coords         streamCoordinates
+		params         map[string]interface{}
+		expectedBody   map[string]interface{}
+		expectedErrMsg string
+	}{
+		{
+			name:   "TCP ingress",
+			coords: tcp,
+			params: map[string]interface{}{"key": "value"},
+			expectedBody: map[string]interface{}{
+				"key":            "value",
+				"__ow_stream":    streamParams{Host: "localhost", Port: "8080", Session: "s1", Token: "secret", Version: "1"},
+				"STREAM_HOST":    "localhost",
+				"STREAM_PORT":    "8080",
+				"STREAM_SESSION": "s1",
+				"STREAM_TOKEN":   "secret",
+			},
+		},
+		{
+			name:   "HTTP ingress",
+			coords: streamCoordinates{URL: "http://streamer/ingest/s1", Session: "s1", Token: "secret"},
+			params: map[string]interface{}{"key": "value"},
+			expectedBody: map[string]interface{}{
+				"key":            "value",
+				"__ow_stream":    streamParams{URL: "http://streamer/ingest/s1", Session: "s1", Token: "secret", Version: "1"},
+				"STREAM_URL":     "http://streamer/ingest/s1",
+				"STREAM_SESSION": "s1",
+				"STREAM_TOKEN":   "secret",
+			},
+		},
+		{
+			name:   "Custom parameter without the legacy ones",
+			cfg:    Config{StreamParam: "streamer", OmitLegacyParams: true},
+			coords: tcp,
+			params: map[string]interface{}{"key": "value"},
+			expectedBody: map[string]interface{}{
+				"key":      "value",
+				"streamer": streamParams{Host: "localhost", Port: "8080", Session: "s1", Token: "secret", Version: "1"},
+			},
+		},
+		{
+			name:           "Spoofed stream parameter",
+			coords:         tcp,
+			params:         map[string]interface{}{"__ow_stream": map[string]interface{}{"session": "s2"}},
+			expectedErrMsg: "The parameter __ow_stream is reserved",
+		},
+		{
+			name:           "Spoofed legacy parameter",
+			cfg:            Config{OmitLegacyParams: true},
+			coords:         tcp,
+			params:         map[string]interface{}{"STREAM_HOST": "attacker"},
+			expectedErrMsg: "The parameter STREAM_HOST is reserved",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := injectStreamParams(tt.params, &tt.cfg, tt.coords)
+			if tt.expectedErrMsg != "" {
+				require.EqualError(t, err, tt.expectedErrMsg)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedBody, tt.params)
+		})
+	}
+}
+
 func TestGetNamespaceAndAction(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -125,3 +185,109 @@ func TestGetNamespaceAndAction(t *testing.T) {
 		})
 	}
 }
+
+func TestGetStreamCoordinates(t *testing.T) {
+	cfg := &Config{StreamHost: "10.0.0.1", StreamPort: "8282", StreamURL: "http://streamer:8080"}
+	sess := &stream.Session{ID: "s1", Token: "secret"}
+
+	tests := []struct {
+		name           string
+		ingress        string
+		expected       streamCoordinates
+		expectedErrMsg string
+	}{
+		{
+			name:     "Default",
+			expected: streamCoordinates{Host: "10.0.0.1", Port: "8282", Session: "s1", Token: "secret"},
+		},
+		{
+			name:     "TCP",
+			ingress:  "tcp",
+			expected: streamCoordinates{Host: "10.0.0.1", Port: "8282", Session: "s1", Token: "secret"},
+		},
+		{
+			name:     "HTTP",
+			ingress:  "http",
+			expected: streamCoordinates{URL: "http://streamer:8080/ingest/s1", Session: "s1", Token: "secret"},
+		},
+		{
+			name:     "WebSocket",
+			ingress:  "ws",
+			expected: streamCoordinates{URL: "ws://streamer:8080/ingest/s1", Session: "s1", Token: "secret"},
+		},
+		{
+			name:           "Unsupported",
+			ingress:        "carrier-pigeon",
+			expectedErrMsg: "Unsupported stream ingress",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/", nil)
+			require.NoError(t, err)
+			if tt.ingress != "" {
+				req.Header.Set("X-Stream-Ingress", tt.ingress)
+			}
+
+			coords, err := getStreamCoordinates(req, cfg, sess)
+			if tt.expectedErrMsg != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.expectedErrMsg)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, coords)
+		})
+	}
+}
+
+func TestWebSocketURL(t *testing.T) {
+	require.Equal(t, "ws://streamer:8080", webSocketURL("http://streamer:8080"))
+	require.Equal(t, "wss://streamer.example.com", webSocketURL("https://streamer.example.com"))
+}
+
+func TestGetPolicy(t *testing.T) {
+	cfg := &Config{Sessions: stream.NewRegistry()}
+	cfg.Sessions.Policy = stream.PolicyDropOldest
+
+	tests := []struct {
+		name           string
+		url            string
+		expected       stream.Policy
+		expectedErrMsg string
+	}{
+		{
+			name:     "Default",
+			url:      "/action/ns/hello",
+			expected: stream.PolicyDropOldest,
+		},
+		{
+			name:     "Asked",
+			url:      "/action/ns/hello?policy=disconnect",
+			expected: stream.PolicyDisconnect,
+		},
+		{
+			name:           "Unsupported",
+			url:            "/action/ns/hello?policy=yolo",
+			expectedErrMsg: "unsupported slow client policy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", tt.url, nil)
+			require.NoError(t, err)
+
+			policy, err := getPolicy(req, cfg)
+			if tt.expectedErrMsg != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.expectedErrMsg)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, policy)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+)
+
+// IngestHandler receives the stream of an action over HTTP, for the
+// runtimes where a raw TCP connection is not an option. The request body is
+// read like the TCP socket and the stream ends with it, unless the partial
+// query parameter says that more requests will follow.
+func IngestHandler(cfg *Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := cfg.Sessions.Get(r.PathValue("session"))
+		if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+
+		token, err := extractAuthToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := sess.ClaimRequest(token); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		partial := r.URL.Query().Get("partial") == "true"
+
+		body := bufio.NewReader(r.Body)
+		defer r.Body.Close()
+
+		mode := stream.ModeRaw
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-ndjson" {
+			mode = stream.ModeNDJSON
+		} else {
+			mode, err = stream.NegotiateProtocol(body)
+		}
+		if err == nil {
+			err = stream.Relay(sess, body, mode)
+		}
+
+		switch {
+		case err == stream.ErrEnded:
+			w.WriteHeader(http.StatusNoContent)
+		case sess.StreamContext().Err() != nil:
+			http.Error(w, "Session closed", http.StatusGone)
+		case err == io.EOF:
+			if !partial {
+				sess.Send(stream.EndMessage(stream.Trailer{}))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			log.Println("Error reading ingest request:", err)
+			sess.Send(stream.EndMessage(stream.Trailer{Status: "error", Error: err.Error()}))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
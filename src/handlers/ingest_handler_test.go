@@ -0,0 +1,154 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		url            string
+		contentType    string
+		body           string
+		expectedStatus int
+		expected       []stream.Message
+	}{
+		{
+			name:           "Raw body",
+			url:            "/ingest/%s",
+			body:           "hello",
+			expectedStatus: http.StatusNoContent,
+			expected: []stream.Message{
+				{Data: "hello"},
+				stream.EndMessage(stream.Trailer{}),
+			},
+		},
+		{
+			name:           "Partial body",
+			url:            "/ingest/%s?partial=true",
+			body:           "hello",
+			expectedStatus: http.StatusNoContent,
+			expected: []stream.Message{
+				{Data: "hello"},
+			},
+		},
+		{
+			name:           "NDJSON content type",
+			url:            "/ingest/%s",
+			contentType:    "application/x-ndjson; charset=utf-8",
+			body:           "{\"event\": \"token\", \"data\": \"hi\"}\n{\"control\": \"end\", \"status\": \"success\"}\n",
+			expectedStatus: http.StatusNoContent,
+			expected: []stream.Message{
+				{Event: "token", Data: "hi"},
+				stream.EndMessage(stream.Trailer{Status: "success"}),
+			},
+		},
+		{
+			name:           "Protocol header",
+			url:            "/ingest/%s?partial=true",
+			body:           "OSSTREAM/1 ndjson\n{\"data\": \"first\"}\n{\"data\": \"second\"}",
+			expectedStatus: http.StatusNoContent,
+			expected: []stream.Message{
+				{Data: "first"},
+				{Data: "second"},
+			},
+		},
+		{
+			name:           "Invalid protocol header",
+			url:            "/ingest/%s",
+			body:           "OSSTREAM/1 morse\n",
+			expectedStatus: http.StatusBadRequest,
+			expected: []stream.Message{
+				stream.EndMessage(stream.Trailer{Status: "error", Error: `unsupported protocol mode "morse"`}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cfg := &Config{Sessions: stream.NewRegistry()}
+			sess, err := cfg.Sessions.Open(ctx)
+			require.NoError(t, err)
+
+			received := make(chan stream.Message, 10)
+			go func() {
+				for msg := range sess.Messages {
+					received <- msg
+				}
+			}()
+
+			req := httptest.NewRequest("POST", strings.Replace(tt.url, "%s", sess.ID, 1), strings.NewReader(tt.body))
+			req.SetPathValue("session", sess.ID)
+			req.Header.Set("Authorization", "Bearer "+sess.Token)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+
+			IngestHandler(cfg)(rec, req)
+			require.Equal(t, tt.expectedStatus, rec.Code)
+
+			for _, msg := range tt.expected {
+				select {
+				case receivedData := <-received:
+					require.Equal(t, msg, receivedData)
+				case <-time.After(1 * time.Second):
+					require.Fail(t, "Timeout waiting for data")
+				}
+			}
+			require.Empty(t, received)
+		})
+	}
+}
+
+func TestIngestHandlerAuthorization(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{Sessions: stream.NewRegistry()}
+	sess, err := cfg.Sessions.Open(ctx)
+	require.NoError(t, err)
+
+	post := func(session string, auth string) int {
+		req := httptest.NewRequest("POST", "/ingest/"+session, strings.NewReader("data"))
+		req.SetPathValue("session", session)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		IngestHandler(cfg)(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusNotFound, post("unknown", "Bearer "+sess.Token))
+	require.Equal(t, http.StatusUnauthorized, post(sess.ID, ""))
+	require.Equal(t, http.StatusForbidden, post(sess.ID, "Bearer guess"))
+}
@@ -0,0 +1,82 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+)
+
+// InputHandler sends the request body to the running action as one
+// message, for the clients reading the stream as Server-Sent Events. The
+// session id is shared with every client of the stream, so the request
+// carries the input token too, returned only to the client invoking the
+// action in the X-Stream-Input-Token header.
+func InputHandler(cfg *Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := cfg.Sessions.Get(r.PathValue("session"))
+		if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+
+		token, err := extractAuthToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := sess.CheckInputToken(token); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		event := r.URL.Query().Get("event")
+		if strings.ContainsAny(event, "\r\n") {
+			http.Error(w, "Invalid event name", http.StatusBadRequest)
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(r.Body, stream.MaxMessageSize+1))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(data) > stream.MaxMessageSize {
+			http.Error(w, "Input too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		msg := stream.DataMessage(data)
+		msg.Event = event
+
+		if err := sess.SendInput(r.Context(), msg); err != nil {
+			if sess.StreamContext().Err() != nil {
+				http.Error(w, "Session closed", http.StatusGone)
+				return
+			}
+			log.Println("Input request abandoned:", err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
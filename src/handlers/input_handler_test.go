@@ -0,0 +1,134 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInputHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		url            string
+		body           string
+		auth           string
+		expectedStatus int
+		expected       *stream.Message
+	}{
+		{
+			name:           "Data",
+			url:            "/session/%s/input",
+			body:           "hello action",
+			expectedStatus: http.StatusAccepted,
+			expected:       &stream.Message{Data: "hello action"},
+		},
+		{
+			name:           "Named event",
+			url:            "/session/%s/input?event=cancel",
+			expectedStatus: http.StatusAccepted,
+			expected:       &stream.Message{Event: "cancel"},
+		},
+		{
+			name:           "Invalid event name",
+			url:            "/session/%s/input?event=a%0Ab",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Missing input token",
+			url:            "/session/%s/input",
+			auth:           "none",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Invalid input token",
+			url:            "/session/%s/input",
+			auth:           "guess",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Too large",
+			url:            "/session/%s/input",
+			body:           strings.Repeat("x", stream.MaxMessageSize+1),
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cfg := &Config{Sessions: stream.NewRegistry()}
+			sess, err := cfg.Sessions.Open(ctx)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest("POST", strings.Replace(tt.url, "%s", sess.ID, 1), strings.NewReader(tt.body))
+			req.SetPathValue("session", sess.ID)
+			switch tt.auth {
+			case "":
+				req.Header.Set("Authorization", "Bearer "+sess.InputToken)
+			case "none":
+			default:
+				req.Header.Set("Authorization", "Bearer "+tt.auth)
+			}
+			rec := httptest.NewRecorder()
+
+			InputHandler(cfg)(rec, req)
+			require.Equal(t, tt.expectedStatus, rec.Code)
+
+			if tt.expected == nil {
+				require.Empty(t, sess.Input)
+				return
+			}
+			require.Equal(t, *tt.expected, <-sess.Input)
+		})
+	}
+}
+
+func TestInputHandlerSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cfg := &Config{Sessions: stream.NewRegistry()}
+	sess, err := cfg.Sessions.Open(ctx)
+	require.NoError(t, err)
+
+	post := func(session string) int {
+		req := httptest.NewRequest("POST", "/session/"+session+"/input", strings.NewReader("data"))
+		req.SetPathValue("session", session)
+		req.Header.Set("Authorization", "Bearer "+sess.InputToken)
+		rec := httptest.NewRecorder()
+		InputHandler(cfg)(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusNotFound, post("unknown"))
+
+	// fill the input buffer, then end the session while the input waits
+	for len(sess.Input) < cap(sess.Input) {
+		require.Equal(t, http.StatusAccepted, post(sess.ID))
+	}
+	cancel()
+	require.Contains(t, []int{http.StatusGone, http.StatusNotFound}, post(sess.ID))
+}
@@ -0,0 +1,78 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+)
+
+// now is the clock of the start times, replaced in the tests.
+var now = time.Now
+
+// streamMeta describes the invocation behind a stream, for the support
+// requests and the log lookups of the clients.
+type streamMeta struct {
+	ActivationID string    `json:"activationId,omitempty"`
+	Namespace    string    `json:"namespace"`
+	Action       string    `json:"action"`
+	Session      string    `json:"session"`
+	Start        time.Time `json:"start"`
+}
+
+func newStreamMeta(namespace, action string, sess *stream.Session) streamMeta {
+	return streamMeta{Namespace: namespace, Action: action, Session: sess.ID, Start: now().UTC()}
+}
+
+// message returns the "meta" event of the stream.
+func (m streamMeta) message() stream.Message {
+	data, err := json.Marshal(m)
+	if err != nil {
+		data = []byte("{}")
+	}
+	return stream.Message{Event: "meta", Data: string(data)}
+}
+
+// openStream records the meta event opening the stream, then starts
+// recording the output of the action.
+func openStream(sess *stream.Session, meta streamMeta) {
+	sess.Replay.Record(sess.Context(), meta.message())
+	go sess.Record()
+}
+
+// webActivationMeta returns the function completing the meta event of a
+// web action with its activation id, which is known only once the web
+// action replied, at the end of the stream.
+func webActivationMeta(meta streamMeta, activationIds <-chan string) func(ctx context.Context) (stream.Message, error) {
+	return func(ctx context.Context) (stream.Message, error) {
+		select {
+		case activationId, ok := <-activationIds:
+			if !ok || activationId == "" {
+				return stream.Message{}, errors.New("no activation id in the reply of the web action")
+			}
+			meta.ActivationID = activationId
+			return meta.message(), nil
+		case <-ctx.Done():
+			return stream.Message{}, ctx.Err()
+		}
+	}
+}
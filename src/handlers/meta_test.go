@@ -0,0 +1,82 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStart is the start time of the streams in the tests.
+var fakeStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func init() {
+	now = func() time.Time { return fakeStart }
+}
+
+// metaData returns the data of the meta event of the fake activation.
+func metaData(session string) string {
+	return fmt.Sprintf(`{"activationId":"a1b2c3","namespace":"ns1","action":"hello","session":"%s","start":"2024-05-01T12:00:00Z"}`, session)
+}
+
+// metaEvent returns the meta event opening the streams of the fake
+// activation, in the given format.
+func metaEvent(format streamFormat, session string) string {
+	var buf bytes.Buffer
+	format.write(&buf, stream.Message{Event: "meta", ID: "1", Data: metaData(session)})
+	return buf.String()
+}
+
+func TestStreamMeta(t *testing.T) {
+	sess := &stream.Session{ID: "s1"}
+	meta := newStreamMeta("ns1", "pkg/hello", sess)
+	require.Equal(t, stream.Message{
+		Event: "meta",
+		Data:  `{"namespace":"ns1","action":"pkg/hello","session":"s1","start":"2024-05-01T12:00:00Z"}`,
+	}, meta.message())
+
+	meta.ActivationID = "a1b2c3"
+	require.Contains(t, meta.message().Data, `"activationId":"a1b2c3"`)
+}
+
+func TestWebActivationMeta(t *testing.T) {
+	meta := newStreamMeta("ns1", "hello", &stream.Session{ID: "s1"})
+
+	activationIds := make(chan string, 1)
+	activationIds <- "a1b2c3"
+	msg, err := webActivationMeta(meta, activationIds)(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "meta", msg.Event)
+	require.Contains(t, msg.Data, `"activationId":"a1b2c3"`)
+
+	// the web action replied without an activation id
+	close(activationIds)
+	_, err = webActivationMeta(meta, activationIds)(context.Background())
+	require.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = webActivationMeta(meta, make(chan string))(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -18,11 +18,30 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/apache/openserverless-streaming-proxy/stream"
 	"github.com/apache/openwhisk-client-go/whisk"
 )
 
+const (
+	// activationPollInterval is how often an activation record is asked
+	// for at the end of the stream, until OpenWhisk stored it.
+	activationPollInterval = 200 * time.Millisecond
+	// activationWatchInterval is how often a running activation is checked
+	// for a failure, until the action connects.
+	activationWatchInterval = time.Second
+	// activationWatchMaxInterval bounds the checks of an activation, which
+	// back off once the action connected: its crashes close the connection.
+	activationWatchMaxInterval = time.Minute
+)
+
 func NewOpenWhiskClient(apiHost string, apiKey string, namespace string) *whisk.Client {
 	client, err := whisk.NewClient(http.DefaultClient,
 		&whisk.Config{
@@ -37,3 +56,192 @@ func NewOpenWhiskClient(apiHost string, apiKey string, namespace string) *whisk.
 
 	return client
 }
+
+// invokeAction invokes an action without waiting for its result, returning
+// the activation id.
+func invokeAction(client *whisk.Client, action string, params map[string]interface{}) (string, error) {
+	res, httpResp, err := client.Actions.Invoke(action, params, false, false)
+	if err != nil {
+		return "", err
+	}
+
+	if httpResp.StatusCode != http.StatusAccepted {
+		return "", errors.New("Error invoking action: " + httpResp.Status)
+	}
+
+	m, ok := res.(map[string]interface{})
+	if !ok {
+		return "", errors.New("Unexpected reply from action invocation")
+	}
+
+	activationId, _ := m["activationId"].(string)
+	return activationId, nil
+}
+
+// activationResult is the final result of an action, sent to the client
+// as a "result" event.
+type activationResult struct {
+	ActivationID string       `json:"activationId"`
+	Status       string       `json:"status"`
+	Success      bool         `json:"success"`
+	Duration     int64        `json:"duration"`
+	Result       whisk.Result `json:"result,omitempty"`
+	Logs         []string     `json:"logs,omitempty"`
+}
+
+func newActivationResult(activation *whisk.Activation, logs bool) activationResult {
+	result := activationResult{
+		ActivationID: activation.ActivationID,
+		Status:       activation.Response.Status,
+		Success:      activation.Response.Success,
+		Duration:     activation.Duration,
+		Result:       activation.Response.Result,
+	}
+	if logs {
+		result.Logs = activation.Logs
+	}
+	return result
+}
+
+// activationWatcher polls the record of an activation, stored by OpenWhisk
+// once the activation completed. It ends the stream with an "error" event
+// when the activation fails before the action ended its stream, e.g. when
+// the action crashed or timed out before connecting, and otherwise gives
+// the record to the "result" event at the end of the stream.
+type activationWatcher struct {
+	client *whisk.Client
+	logs   bool
+
+	// the intervals between the polls, see the constants
+	interval     time.Duration
+	maxInterval  time.Duration
+	pollInterval time.Duration
+
+	// ending is closed when the result is asked for, done once the record
+	// is fetched or the watch gave up with err
+	ending     chan struct{}
+	endOnce    sync.Once
+	done       chan struct{}
+	activation *whisk.Activation
+	err        error
+}
+
+// newActivationWatcher returns a watcher polling with the given client,
+// which must not be shared, as fetching an activation changes its
+// namespace. The results carry the logs of the activation if asked for.
+func newActivationWatcher(client *whisk.Client, logs bool) *activationWatcher {
+	return &activationWatcher{
+		client:       client,
+		logs:         logs,
+		interval:     activationWatchInterval,
+		maxInterval:  activationWatchMaxInterval,
+		pollInterval: activationPollInterval,
+		ending:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// watch ends the stream with an "error" event when the activation fails
+// before the stream ended.
+func (w *activationWatcher) watch(sess *stream.Session, activationId string) {
+	activation, err := w.poll(sess, activationId)
+	if err != nil {
+		if sess.StreamContext().Err() == nil {
+			log.Println("Error watching activation", activationId+":", err)
+		}
+		return
+	}
+
+	select {
+	case <-w.ending:
+		// the record is the result of the stream
+		return
+	default:
+	}
+	if activation.Response.Success {
+		return
+	}
+
+	log.Println("Activation", activationId, "failed:", activation.Response.Status)
+	data, err := json.Marshal(newActivationResult(activation, w.logs))
+	if err != nil {
+		data = []byte("{}")
+	}
+	// the error is the result of the action
+	sess.SetResult(nil)
+	sess.Send(stream.Message{Event: "error", Data: string(data), End: true})
+}
+
+// poll fetches the record of the activation every interval until the
+// action connects to the session, then backing off up to maxInterval, and
+// every pollInterval once the result is asked for. The errors of the
+// network and of OpenWhisk, e.g. a throttled request, are retried alike:
+// it gives up when the key is refused, or when the stream is over.
+func (w *activationWatcher) poll(sess *stream.Session, activationId string) (activation *whisk.Activation, err error) {
+	defer func() {
+		w.activation, w.err = activation, err
+		close(w.done)
+	}()
+
+	interval := w.interval
+	ending := w.ending
+	for {
+		activation, httpResp, err := w.client.Activations.Get(activationId)
+		if err == nil {
+			return activation, nil
+		}
+		if httpResp != nil && (httpResp.StatusCode == http.StatusUnauthorized || httpResp.StatusCode == http.StatusForbidden) {
+			return nil, err
+		}
+		if httpResp == nil || httpResp.StatusCode != http.StatusNotFound {
+			log.Println("Error fetching activation", activationId+", retrying:", err)
+		}
+
+		select {
+		case <-sess.Claimed():
+			interval = min(interval*2, w.maxInterval)
+		default:
+		}
+		wait := interval
+		select {
+		case <-w.ending:
+			wait = w.pollInterval
+			ending = nil
+		default:
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ending:
+			// the result is asked for, poll at once
+			ending = nil
+			timer.Stop()
+		case <-sess.StreamContext().Done():
+			timer.Stop()
+			return nil, sess.StreamContext().Err()
+		}
+	}
+}
+
+// result returns the "result" event of the stream, with the record of the
+// activation fetched by watch. As the stream can end before the invocation
+// returns, it waits for the watch to start.
+func (w *activationWatcher) result(ctx context.Context) (stream.Message, error) {
+	w.endOnce.Do(func() { close(w.ending) })
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		return stream.Message{}, ctx.Err()
+	}
+	if w.err != nil {
+		return stream.Message{}, w.err
+	}
+
+	data, err := json.Marshal(newActivationResult(w.activation, w.logs))
+	if err != nil {
+		return stream.Message{}, err
+	}
+	return stream.Message{Event: "result", Data: string(data)}, nil
+}
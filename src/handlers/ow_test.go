@@ -0,0 +1,297 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/apache/openwhisk-client-go/whisk"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpenWhisk accepts the action invocations, handing their parameters
+// to the test playing the action, and serves the activation record, failing
+// with the statuses in failures first, then not found for the first pending
+// requests.
+type fakeOpenWhisk struct {
+	*httptest.Server
+	invoked chan map[string]interface{}
+	// keys are the OpenWhisk keys of the invocations
+	keys chan string
+
+	mu         sync.Mutex
+	activation *whisk.Activation
+	pending    int
+	failures   []int
+	// gets counts the requests of the activation record
+	gets int
+}
+
+func newFakeOpenWhisk(t *testing.T) *fakeOpenWhisk {
+	ow := &fakeOpenWhisk{
+		invoked: make(chan map[string]interface{}, 10),
+		keys:    make(chan string, 10),
+		activation: &whisk.Activation{
+			ActivationID: "a1b2c3",
+			Duration:     42,
+			Response:     whisk.Response{Status: "success", Success: true, Result: map[string]interface{}{"answer": 42}},
+			Logs:         []string{"thinking"},
+		},
+	}
+
+	ow.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/_/activations/") {
+			ow.serveActivation(w, r)
+			return
+		}
+		if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		params := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ow.invoked <- params
+		user, pass, _ := r.BasicAuth()
+		ow.keys <- user + ":" + pass
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"activationId": "a1b2c3"}`))
+	}))
+	t.Cleanup(ow.Close)
+
+	return ow
+}
+
+func (ow *fakeOpenWhisk) serveActivation(w http.ResponseWriter, r *http.Request) {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+
+	ow.gets++
+	if len(ow.failures) > 0 {
+		status := ow.failures[0]
+		ow.failures = ow.failures[1:]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error": "` + http.StatusText(status) + `"}`))
+		return
+	}
+	if ow.pending > 0 || ow.activation == nil || path.Base(r.URL.Path) != ow.activation.ActivationID {
+		ow.pending--
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "The requested resource does not exist."}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ow.activation)
+}
+
+func TestInvokeAction(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	client := NewOpenWhiskClient(ow.URL, "user:pass", "ns1")
+
+	activationId, err := invokeAction(client, "pkg/action", map[string]interface{}{"key": "value"})
+	require.NoError(t, err)
+	require.Equal(t, "a1b2c3", activationId)
+	require.Equal(t, map[string]interface{}{"key": "value"}, <-ow.invoked)
+
+	_, err = invokeAction(NewOpenWhiskClient(ow.URL+"/missing", "user:pass", "ns1"), "action", nil)
+	require.Error(t, err)
+}
+
+// newTestWatcher returns a watcher polling the fake OpenWhisk every
+// interval, up to maxInterval.
+func newTestWatcher(ow *fakeOpenWhisk, logs bool, interval, maxInterval time.Duration) *activationWatcher {
+	watcher := newActivationWatcher(NewOpenWhiskClient(ow.URL, "user:pass", "ns1"), logs)
+	watcher.interval = interval
+	watcher.maxInterval = maxInterval
+	watcher.pollInterval = time.Millisecond
+	return watcher
+}
+
+func TestActivationWatcherResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		logs     bool
+		expected string
+	}{
+		{
+			name:     "Result",
+			expected: `{"activationId":"a1b2c3","status":"success","success":true,"duration":42,"result":{"answer":42}}`,
+		},
+		{
+			name:     "Result with the logs",
+			logs:     true,
+			expected: `{"activationId":"a1b2c3","status":"success","success":true,"duration":42,"result":{"answer":42},"logs":["thinking"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ow := newFakeOpenWhisk(t)
+			ow.pending = 2
+			sess, err := stream.NewRegistry().Open(context.Background())
+			require.NoError(t, err)
+			defer sess.Close()
+
+			// the record is polled for until OpenWhisk stored it, quickly
+			// once the result is asked for
+			watcher := newTestWatcher(ow, tt.logs, time.Hour, time.Hour)
+			go watcher.watch(sess, "a1b2c3")
+
+			msg, err := watcher.result(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, stream.Message{Event: "result", Data: tt.expected}, msg)
+
+			// the record fetched by the watch is not fetched again
+			ow.mu.Lock()
+			defer ow.mu.Unlock()
+			require.Equal(t, 3, ow.gets)
+		})
+	}
+}
+
+func TestActivationWatcherErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     []int
+		expectedGets int
+		expectedErr  bool
+	}{
+		{
+			name:         "Transient errors",
+			failures:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusInternalServerError},
+			expectedGets: 5,
+		},
+		{
+			name:         "Refused key",
+			failures:     []int{http.StatusServiceUnavailable, http.StatusUnauthorized},
+			expectedGets: 2,
+			expectedErr:  true,
+		},
+		{
+			name:         "Forbidden",
+			failures:     []int{http.StatusForbidden},
+			expectedGets: 1,
+			expectedErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ow := newFakeOpenWhisk(t)
+			ow.failures = tt.failures
+			sess, err := stream.NewRegistry().Open(context.Background())
+			require.NoError(t, err)
+			defer sess.Close()
+
+			watcher := newTestWatcher(ow, false, time.Millisecond, time.Millisecond)
+			go watcher.watch(sess, "a1b2c3")
+
+			msg, err := watcher.result(context.Background())
+			if tt.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "result", msg.Event)
+			}
+
+			ow.mu.Lock()
+			defer ow.mu.Unlock()
+			require.Equal(t, tt.expectedGets, ow.gets)
+		})
+	}
+}
+
+func TestActivationWatcherNetworkError(t *testing.T) {
+	// nothing listens on the address at first
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	sess, err := stream.NewRegistry().Open(context.Background())
+	require.NoError(t, err)
+	defer sess.Close()
+
+	watcher := newActivationWatcher(NewOpenWhiskClient("http://"+addr, "user:pass", "ns1"), false)
+	watcher.interval = 10 * time.Millisecond
+	watcher.maxInterval = 10 * time.Millisecond
+	watcher.pollInterval = 10 * time.Millisecond
+	go watcher.watch(sess, "a1b2c3")
+	time.Sleep(50 * time.Millisecond)
+
+	// then OpenWhisk comes back
+	listener, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	ow := newFakeOpenWhisk(t)
+	server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(ow.serveActivation)}}
+	server.Start()
+	defer server.Close()
+
+	msg, err := watcher.result(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "result", msg.Event)
+}
+
+func TestActivationWatcherBackoff(t *testing.T) {
+	gets := func(claim bool) int {
+		ow := newFakeOpenWhisk(t)
+		ow.pending = 1000
+		sess, err := stream.NewRegistry().Open(context.Background())
+		require.NoError(t, err)
+		if claim {
+			require.NoError(t, sess.Claim(sess.Token))
+		}
+
+		watcher := newTestWatcher(ow, false, 5*time.Millisecond, 40*time.Millisecond)
+		go watcher.watch(sess, "a1b2c3")
+		time.Sleep(200 * time.Millisecond)
+
+		// the watch gives up with the stream
+		sess.Close()
+		<-watcher.done
+		_, err = watcher.result(context.Background())
+		require.ErrorIs(t, err, context.Canceled)
+
+		ow.mu.Lock()
+		defer ow.mu.Unlock()
+		return ow.gets
+	}
+
+	// the activation is polled often until the action connects, as its
+	// crashes are seen in the activation record only
+	require.Greater(t, gets(false), 20)
+	require.Less(t, gets(true), 12)
+}
@@ -0,0 +1,66 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+)
+
+// sseLineBreaks matches the line endings of the event stream format.
+var sseLineBreaks = regexp.MustCompile("\r\n|\r|\n")
+
+// writeSSE writes a message as a server-sent event. Data spanning many
+// lines is split into many data fields, which the client joins back.
+func writeSSE(w io.Writer, msg stream.Message) error {
+	var sb strings.Builder
+	if msg.Event != "" {
+		sb.WriteString("event: " + msg.Event + "\n")
+	}
+	if msg.ID != "" {
+		sb.WriteString("id: " + msg.ID + "\n")
+	}
+	if msg.Retry > 0 {
+		sb.WriteString("retry: " + strconv.Itoa(msg.Retry) + "\n")
+	}
+	for _, line := range sseLineBreaks.Split(msg.Data, -1) {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeSSEKeepalive writes a comment, which the client ignores.
+func writeSSEKeepalive(w io.Writer) error {
+	_, err := io.WriteString(w, ": keepalive\n\n")
+	return err
+}
+
+// writeSSERetry sets the reconnection time of the client, without
+// dispatching an event.
+func writeSSERetry(w io.Writer, retry time.Duration) error {
+	_, err := io.WriteString(w, "retry: "+strconv.FormatInt(retry.Milliseconds(), 10)+"\n\n")
+	return err
+}
@@ -0,0 +1,81 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSSE(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      stream.Message
+		expected string
+	}{
+		{
+			name:     "Data only",
+			msg:      stream.Message{Data: "hello"},
+			expected: "data: hello\n\n",
+		},
+		{
+			name:     "Typed event",
+			msg:      stream.Message{Event: "progress", Data: `{"percent": 50}`},
+			expected: "event: progress\ndata: {\"percent\": 50}\n\n",
+		},
+		{
+			name:     "All fields",
+			msg:      stream.Message{Event: "token", ID: "7", Data: "hi", Retry: 1000},
+			expected: "event: token\nid: 7\nretry: 1000\ndata: hi\n\n",
+		},
+		{
+			name:     "Multi-line data",
+			msg:      stream.Message{Data: "first\nsecond\r\nthird\rfourth"},
+			expected: "data: first\ndata: second\ndata: third\ndata: fourth\n\n",
+		},
+		{
+			name:     "Trailing line break",
+			msg:      stream.Message{Data: "line\n"},
+			expected: "data: line\ndata: \n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, writeSSE(&buf, tt.msg))
+			require.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
+
+func TestWriteSSEKeepalive(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeSSEKeepalive(&buf))
+	require.Equal(t, ": keepalive\n\n", buf.String())
+}
+
+func TestWriteSSERetry(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeSSERetry(&buf, 5*time.Second))
+	require.Equal(t, "retry: 5000\n\n", buf.String())
+}
@@ -0,0 +1,253 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+)
+
+// SubscribeHandler lets a client read a running stream, alongside the
+// other clients, or resume it after the connection dropped: the messages
+// following the Last-Event-ID header are sent again, then the stream goes
+// on. The session id is no secret, so the request carries the read token
+// returned to the client invoking the action, and the client chooses its
+// own slow client policy with the policy query parameter.
+func SubscribeHandler(cfg *Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := cfg.Sessions.Get(r.PathValue("session"))
+		if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+
+		token, err := extractAuthToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := sess.CheckReadToken(token); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		format, err := negotiateFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+
+		// the stream goes on for the other clients
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		if name := r.URL.Query().Get("policy"); name != "" {
+			if _, err := stream.ParsePolicy(name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var lastID uint64
+		if header := r.Header.Get("Last-Event-ID"); header != "" {
+			lastID, err = strconv.ParseUint(header, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid Last-Event-ID: "+header, http.StatusBadRequest)
+				return
+			}
+		}
+
+		log.Println("Subscribing to stream", sess.ID, "after", lastID)
+		relayStream(w, r, cfg, sess, format, lastID, nil)
+	}
+}
+
+// respondDetached replies to an invocation in detached mode, where the
+// stream is recorded until a client attaches to it with the session id.
+func respondDetached(w http.ResponseWriter, sess *stream.Session, activationId string) {
+	// the session waits for a client, longer than after a disconnection
+	sess.Detach()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/stream/"+sess.ID)
+	w.Header().Set("X-Stream-Session", sess.ID)
+	setStreamTokens(w, sess)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(detachedReply{Session: sess.ID, ReadToken: sess.ReadToken, InputToken: sess.InputToken, ActivationID: activationId})
+}
+
+type detachedReply struct {
+	Session      string `json:"session"`
+	ReadToken    string `json:"readToken"`
+	InputToken   string `json:"inputToken"`
+	ActivationID string `json:"activationId"`
+}
+
+// setStreamTokens gives the client invoking the action the tokens to read
+// the stream again and to send the action input. The client shares the
+// read token with the clients it wants reading the stream, while the input
+// token stays with it.
+func setStreamTokens(w http.ResponseWriter, sess *stream.Session) {
+	w.Header().Set("X-Stream-Read-Token", sess.ReadToken)
+	w.Header().Set("X-Stream-Input-Token", sess.InputToken)
+}
+
+// relayStream subscribes the client to the stream of the session, after
+// the message lastID, and writes the messages to it. The messages stay in
+// the replay a while, so that the client can resume the stream when the
+// connection drops. An error of the invocation, if any, ends the stream.
+//
+// While the stream is silent, a heartbeat is written every cfg.Heartbeat,
+// so that the proxies do not close the idle connection. When the streamer
+// shuts down, the client is told when to reconnect, in case the stream is
+// cut before its end.
+func relayStream(w http.ResponseWriter, r *http.Request, cfg *Config, sess *stream.Session, format streamFormat, lastID uint64, invocation <-chan error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		// only the client invoking the action gets here, while nobody else
+		// has the read token yet
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		sess.Close()
+		return
+	}
+
+	sub, err := sess.Subscribe(lastID)
+	if err != nil {
+		http.Error(w, "The stream following the last event is not available anymore", http.StatusGone)
+		return
+	}
+	defer sub.Close()
+	// the client may be slower or faster than the others
+	if policy, err := stream.ParsePolicy(r.URL.Query().Get("policy")); err == nil {
+		sub.SetPolicy(policy)
+	}
+
+	if messages, _, err := sub.Next(); err == nil && len(messages) == 0 && sess.Replay.Ended() {
+		// the client already read the whole stream
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	startStream(w, format)
+	// the session id lets the client send input to the action
+	w.Header().Set("X-Stream-Session", sess.ID)
+
+	// the heartbeat is postponed whenever something is written
+	var heartbeat *time.Timer
+	var beat <-chan time.Time
+	if cfg.Heartbeat > 0 && format.heartbeat != nil {
+		heartbeat = time.NewTimer(cfg.Heartbeat)
+		defer heartbeat.Stop()
+		beat = heartbeat.C
+	}
+	draining := cfg.Draining
+	written := false
+	flush := func() {
+		flusher.Flush()
+		written = true
+		if heartbeat != nil {
+			heartbeat.Reset(cfg.Heartbeat)
+		}
+	}
+
+	for {
+		messages, changed, err := sub.Next()
+		if err == stream.ErrSlowClient {
+			log.Println("Disconnecting slow client of stream", sess.ID)
+			format.write(w, stream.DroppedMessage(stream.Dropped{Disconnected: true}))
+			flusher.Flush()
+			return
+		}
+
+		for _, msg := range messages {
+			if msg.Event == "dropped" && msg.ID == "" {
+				log.Println("Messages of stream", sess.ID, "dropped for a slow client:", msg.Data)
+			}
+			if err := format.write(w, msg); err != nil {
+				log.Println("Error writing to HTTP response:", err)
+				return
+			}
+		}
+		if len(messages) > 0 {
+			last := messages[len(messages)-1]
+			flush()
+			id, _ := strconv.ParseUint(last.ID, 10, 64)
+			sub.MarkRead(id)
+
+			if last.End {
+				log.Println("End of stream received, closing connection")
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-changed:
+
+		case <-beat:
+			if err := format.heartbeat(w); err != nil {
+				log.Println("Error writing to HTTP response:", err)
+				return
+			}
+			flush()
+
+		case <-draining:
+			draining = nil
+			if format.reconnect == nil {
+				continue
+			}
+			if err := format.reconnect(w, ShutdownRetry); err != nil {
+				log.Println("Error writing to HTTP response:", err)
+				return
+			}
+			flush()
+
+		case <-r.Context().Done():
+			log.Println("HTTP Client closed connection")
+			return
+
+		case <-sess.Context().Done():
+			log.Println("Session closed")
+			return
+
+		case err, ok := <-invocation:
+			if !ok {
+				// the action completed, keep relaying until the end of stream
+				invocation = nil
+				continue
+			}
+			log.Println("Error invoking action:", err)
+			if written {
+				// the response already started, the error ends the stream
+				format.write(w, stream.EndMessage(stream.Trailer{Status: "error", Error: err.Error()}))
+				flusher.Flush()
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			sess.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/stretchr/testify/require"
+)
+
+func newStreamServer(t *testing.T, cfg *Config) *httptest.Server {
+	router := http.NewServeMux()
+	router.HandleFunc("POST /action/{ns}/{action}", ActionStreamHandler(cfg))
+	router.HandleFunc("GET /stream/{session}", SubscribeHandler(cfg))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getStream(t *testing.T, server *httptest.Server, session string, readToken string, lastID string) *http.Response {
+	req, err := http.NewRequest("GET", server.URL+"/stream/"+session, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/x-ndjson")
+	if readToken != "" {
+		req.Header.Set("Authorization", "Bearer "+readToken)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestResumeHandler(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+	server := newStreamServer(t, cfg)
+	playAction(ow, cfg,
+		stream.Message{Data: "one"},
+		stream.Message{Data: "two"},
+		stream.EndMessage(stream.Trailer{}),
+	)
+
+	req, err := http.NewRequest("POST", server.URL+"/action/ns1/hello", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer user:pass")
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	// the client drops the connection after the first message
+	session := resp.Header.Get("X-Stream-Session")
+	readToken := resp.Header.Get("X-Stream-Read-Token")
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, metaEvent(formatNDJSON, session), line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "{\"id\":\"2\",\"data\":\"one\"}\n", line)
+	resp.Body.Close()
+
+	// and resumes the stream where it left off
+	resp = getStream(t, server, session, readToken, "2")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "{\"id\":\"3\",\"data\":\"two\"}\n{\"event\":\"result\",\"id\":\"4\",\"data\":\"{\\\"activationId\\\":\\\"a1b2c3\\\",\\\"status\\\":\\\"success\\\",\\\"success\\\":true,\\\"duration\\\":42,\\\"result\\\":{\\\"answer\\\":42}}\"}\n{\"event\":\"end\",\"id\":\"5\",\"data\":\"{}\"}\n", string(body))
+
+	// the stream can be read again from the start while the session is kept
+	resp = getStream(t, server, session, readToken, "")
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, 5, strings.Count(string(body), "\n"))
+
+	require.Equal(t, http.StatusNoContent, getStream(t, server, session, readToken, "5").StatusCode)
+	require.Equal(t, http.StatusGone, getStream(t, server, session, readToken, "9").StatusCode)
+	require.Equal(t, http.StatusBadRequest, getStream(t, server, session, readToken, "last").StatusCode)
+	require.Equal(t, http.StatusNotFound, getStream(t, server, "unknown", readToken, "").StatusCode)
+
+	// the session id alone does not give the stream
+	require.Equal(t, http.StatusUnauthorized, getStream(t, server, session, "", "").StatusCode)
+	require.Equal(t, http.StatusForbidden, getStream(t, server, session, "guess", "").StatusCode)
+}
+
+func TestResumeHandlerDropped(t *testing.T) {
+	cfg := &Config{Sessions: stream.NewRegistry()}
+	cfg.Sessions.ReplaySize = 1
+	server := newStreamServer(t, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sess, err := cfg.Sessions.Open(ctx)
+	require.NoError(t, err)
+	// a client reads the stream while it is recorded
+	sub, err := sess.Subscribe(0)
+	require.NoError(t, err)
+	for i, msg := range []stream.Message{{Data: "one"}, {Data: "two"}, stream.EndMessage(stream.Trailer{})} {
+		_, err := sess.Replay.Record(ctx, msg)
+		require.NoError(t, err)
+		sub.MarkRead(uint64(i + 1))
+	}
+	sub.Close()
+
+	// the second message was dropped
+	require.Equal(t, http.StatusGone, getStream(t, server, sess.ID, sess.ReadToken, "1").StatusCode)
+
+	// without Last-Event-ID the stream starts from the oldest message kept
+	resp := getStream(t, server, sess.ID, sess.ReadToken, "")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "{\"event\":\"end\",\"id\":\"3\",\"data\":\"{}\"}\n", string(body))
+}
+
+func TestSubscribeHandlerFanOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{Sessions: stream.NewRegistry()}
+	server := newStreamServer(t, cfg)
+
+	sess, err := cfg.Sessions.Open(ctx)
+	require.NoError(t, err)
+	go sess.Record()
+
+	// every client gets the whole stream
+	bodies := make(chan string, 3)
+	for i := 0; i < cap(bodies); i++ {
+		go func() {
+			req, _ := http.NewRequest("GET", server.URL+"/stream/"+sess.ID, nil)
+			req.Header.Set("Accept", "application/x-ndjson")
+			req.Header.Set("Authorization", "Bearer "+sess.ReadToken)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				bodies <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			bodies <- string(body)
+		}()
+	}
+
+	go func() {
+		sess.Send(stream.Message{Data: "shared"})
+		sess.Send(stream.EndMessage(stream.Trailer{}))
+	}()
+
+	for i := 0; i < cap(bodies); i++ {
+		require.Equal(t, "{\"id\":\"1\",\"data\":\"shared\"}\n{\"event\":\"end\",\"id\":\"2\",\"data\":\"{}\"}\n", <-bodies)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/stream/"+sess.ID+"?policy=never", nil)
+	req.Header.Set("Authorization", "Bearer "+sess.ReadToken)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// unflushableWriter is a ResponseWriter that cannot stream.
+type unflushableWriter struct {
+	http.ResponseWriter
+}
+
+func TestSubscribeHandlerStreamingUnsupported(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &Config{Sessions: stream.NewRegistry()}
+	sess, err := cfg.Sessions.Open(ctx)
+	require.NoError(t, err)
+
+	router := http.NewServeMux()
+	router.HandleFunc("GET /stream/{session}", SubscribeHandler(cfg))
+	req := httptest.NewRequest("GET", "/stream/"+sess.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+sess.ReadToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(unflushableWriter{w}, req)
+
+	// the subscriber is refused, while the stream goes on for the others
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.NoError(t, sess.Context().Err())
+}
+
+// stalledWriter holds the first write until released, like a slow client.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+	writing chan struct{}
+	once    sync.Once
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.release
+	})
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestRelayStreamSlowClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy stream.Policy
+		target string
+	}{
+		{
+			name:   "Policy of the stream",
+			policy: stream.PolicyDisconnect,
+			target: "/stream/%s",
+		},
+		{
+			name:   "Policy of the client",
+			policy: stream.PolicyBlock,
+			target: "/stream/%s?policy=disconnect",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cfg := &Config{Sessions: stream.NewRegistry()}
+			cfg.Sessions.ReplaySize = 1
+			cfg.Sessions.Policy = tt.policy
+			sess, err := cfg.Sessions.Open(ctx)
+			require.NoError(t, err)
+
+			w := &stalledWriter{
+				ResponseRecorder: httptest.NewRecorder(),
+				release:          make(chan struct{}),
+				writing:          make(chan struct{}),
+			}
+			done := make(chan struct{})
+			go func() {
+				relayStream(w, httptest.NewRequest("GET", fmt.Sprintf(tt.target, sess.ID), nil), cfg, sess, formatNDJSON, 0, nil)
+				close(done)
+			}()
+
+			// the client is stuck on the first message when the second one comes
+			_, err = sess.Replay.Record(ctx, stream.Message{Data: "first"})
+			require.NoError(t, err)
+			<-w.writing
+			_, err = sess.Replay.Record(ctx, stream.Message{Data: "second"})
+			require.NoError(t, err)
+
+			close(w.release)
+			<-done
+			require.Equal(t, "{\"id\":\"1\",\"data\":\"first\"}\n{\"event\":\"dropped\",\"data\":\"{\\\"disconnected\\\":true}\"}\n", w.Body.String())
+		})
+	}
+}
+
+func TestRelayStreamHeartbeat(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    streamFormat
+		heartbeat bool
+		expected  string
+	}{
+		{
+			name:      "server-sent events",
+			format:    formatSSE,
+			heartbeat: true,
+			expected:  "id: 1\ndata: hello\n\nevent: end\nid: 2\ndata: {}\n\n",
+		},
+		{
+			name:     "ndjson",
+			format:   formatNDJSON,
+			expected: "{\"id\":\"1\",\"data\":\"hello\"}\n{\"event\":\"end\",\"id\":\"2\",\"data\":\"{}\"}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cfg := &Config{Sessions: stream.NewRegistry(), Heartbeat: 20 * time.Millisecond}
+			sess, err := cfg.Sessions.Open(ctx)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				relayStream(w, httptest.NewRequest("GET", "/stream/"+sess.ID, nil), cfg, sess, tt.format, 0, nil)
+				close(done)
+			}()
+
+			// the action is thinking for a while
+			time.Sleep(70 * time.Millisecond)
+			_, err = sess.Replay.Record(ctx, stream.Message{Data: "hello"})
+			require.NoError(t, err)
+			_, err = sess.Replay.Record(ctx, stream.EndMessage(stream.Trailer{}))
+			require.NoError(t, err)
+			<-done
+
+			// the heartbeats leave the events and their ids as they are
+			body := w.Body.String()
+			require.Equal(t, tt.heartbeat, strings.HasPrefix(body, ": keepalive\n\n"))
+			require.Equal(t, tt.expected, strings.ReplaceAll(body, ": keepalive\n\n", ""))
+		})
+	}
+}
+
+func TestRelayStreamDraining(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   streamFormat
+		expected string
+	}{
+		{
+			name:     "server-sent events",
+			format:   formatSSE,
+			expected: "retry: 5000\n\nid: 1\ndata: hello\n\nevent: end\nid: 2\ndata: {}\n\n",
+		},
+		{
+			name:     "ndjson",
+			format:   formatNDJSON,
+			expected: "{\"event\":\"reconnect\",\"data\":\"\",\"retry\":5000}\n{\"id\":\"1\",\"data\":\"hello\"}\n{\"event\":\"end\",\"id\":\"2\",\"data\":\"{}\"}\n",
+		},
+		{
+			name:     "raw",
+			format:   formatRaw,
+			expected: "hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			draining := make(chan struct{})
+			cfg := &Config{Sessions: stream.NewRegistry(), Draining: draining}
+			sess, err := cfg.Sessions.Open(ctx)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				relayStream(w, httptest.NewRequest("GET", "/stream/"+sess.ID, nil), cfg, sess, tt.format, 0, nil)
+				close(done)
+			}()
+
+			// the client is told to reconnect later, and the running stream
+			// goes on until its end
+			close(draining)
+			time.Sleep(20 * time.Millisecond)
+			_, err = sess.Replay.Record(ctx, stream.Message{Data: "hello"})
+			require.NoError(t, err)
+			_, err = sess.Replay.Record(ctx, stream.EndMessage(stream.Trailer{}))
+			require.NoError(t, err)
+			<-done
+
+			require.Equal(t, tt.expected, w.Body.String())
+		})
+	}
+}
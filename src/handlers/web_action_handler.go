@@ -18,90 +18,98 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
-
-	"github.com/apache/openserverless-streaming-proxy/tcp"
 )
 
-func WebActionStreamHandler(streamingProxyAddr string, apihost string) func(http.ResponseWriter, *http.Request) {
+func WebActionStreamHandler(cfg *Config) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx, done := context.WithCancel(context.Background())
-
 		namespace, actionToInvoke := getNamespaceAndAction(r)
-		log.Println(fmt.Sprintf("Web Action requested: %s (%s)", actionToInvoke, namespace))
+		log.Println(fmt.Sprintf("Web Action requested: %s %s (%s)", r.Method, actionToInvoke, namespace))
+
+		if refuseWhileDraining(w, cfg) {
+			return
+		}
 
-		// opens a socket for listening in a random port
-		sock, err := tcp.SetupTcpServer(ctx, streamingProxyAddr)
+		format, err := negotiateFormat(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			done()
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+
+		policy, err := getPolicy(r, cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// parse the json body and add STREAM_HOST and STREAM_PORT
-		enrichedBody, err := injectHostPortInBody(r, sock.Host, sock.Port)
+		// opens a session the action connects to on the shared socket
+		sess, err := cfg.Sessions.Open(context.Background())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			done()
 			return
 		}
+		sess.Replay.SetPolicy(policy)
 
-		// invoke the action
-		actionToInvoke = ensurePackagePresent(actionToInvoke)
+		coords, err := getStreamCoordinates(r, cfg, sess)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			sess.Close()
+			return
+		}
+		params := make(map[string]interface{})
+		injectStreamParams(params, cfg, coords)
 
-		jsonData, err := json.Marshal(enrichedBody)
+		// OpenWhisk turns the body into parameters itself, the stream
+		// parameters are merged only into a JSON object
+		body, err := newWebActionBody(r, cfg, params)
+		r.Body.Close()
 		if err != nil {
-			http.Error(w, "Error encoding JSON body: "+err.Error(), http.StatusInternalServerError)
-			done()
+			http.Error(w, err.Error(), paramsErrorStatus(err))
+			sess.Close()
 			return
 		}
-		url := fmt.Sprintf("%s/api/v1/web/%s/%s", apihost, namespace, actionToInvoke)
+		// the query string reaches the action too
+		for name := range r.URL.Query() {
+			if reservedParam(cfg, name) {
+				http.Error(w, "The parameter "+name+" is reserved", http.StatusBadRequest)
+				sess.Close()
+				return
+			}
+		}
 
-		errChan := make(chan error)
-		go asyncPostWebAction(errChan, url, jsonData)
+		// invoke the action
+		actionToInvoke = ensurePackagePresent(actionToInvoke)
 
-		// Flush the headers
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-			done()
+		url := fmt.Sprintf("%s/api/v1/web/%s/%s", cfg.ApiHost, namespace, actionToInvoke)
+		req, err := newWebActionRequest(r, cfg, url, body, params)
+		if err != nil {
+			http.Error(w, "Error preparing the web action request: "+err.Error(), http.StatusInternalServerError)
+			sess.Close()
 			return
 		}
 
-		for {
-			select {
-			case data := <-sock.StreamDataChan:
-				if string(data) == "EOF" {
-					log.Println("EOF received, closing connection")
-					done()
-					return
-				}
-				_, err := w.Write([]byte("data: " + string(data) + "\n\n"))
-				if err != nil {
-					log.Println("Error writing to HTTP response:", err)
-					done()
-					return
-				}
-				flusher.Flush()
-
-			case <-r.Context().Done():
-				log.Println("HTTP Client closed connection")
-				done()
-				return
+		// the activation id of a web action comes with its reply, so it is
+		// sent again at the end of the stream
+		meta := newStreamMeta(namespace, actionToInvoke, sess)
+		activationIds := make(chan string, 1)
+		sess.SetResult(webActivationMeta(meta, activationIds))
+		openStream(sess, meta)
 
-			case err := <-errChan:
-				log.Println("Error invoking action:", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				done()
-				return
-			}
+		errChan := make(chan error, 1)
+		go asyncInvokeWebAction(errChan, activationIds, req)
 
-		}
+		setStreamTokens(w, sess)
+		relayStream(w, r, cfg, sess, format, 0, errChan)
 	}
 }
 
@@ -112,17 +120,145 @@ func ensurePackagePresent(actionToInvoke string) string {
 	return actionToInvoke
 }
 
-func asyncPostWebAction(errChan chan error, url string, body []byte) {
-	bodyReader := strings.NewReader(string(body))
+// webActionBody is the body of the client forwarded to the web action.
+type webActionBody struct {
+	data        []byte
+	contentType string
+	// withParams tells whether the stream parameters were merged in
+	withParams bool
+}
 
-	req, err := http.NewRequest("POST", url, bodyReader)
+// newWebActionBody reads the body of the client request, merging the
+// stream parameters into a JSON object, and an empty body of the methods
+// with a body. The other bodies are forwarded as they are, as OpenWhisk
+// turns them into parameters itself: the forms are only checked for the
+// reserved parameters.
+func newWebActionBody(r *http.Request, cfg *Config, params map[string]interface{}) (webActionBody, error) {
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
 	if err != nil {
-		errChan <- err
-		return
+		return webActionBody{}, err
+	}
+	body := webActionBody{data: data, contentType: r.Header.Get("Content-Type")}
+
+	mediaType := ""
+	if body.contentType != "" {
+		mediaType, _, err = mime.ParseMediaType(body.contentType)
+		if err != nil {
+			return webActionBody{}, fmt.Errorf("%w: %s", errUnsupportedMediaType, body.contentType)
+		}
+	}
+
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(data))
+		if err != nil {
+			return webActionBody{}, err
+		}
+		for name := range values {
+			if reservedParam(cfg, name) {
+				return webActionBody{}, fmt.Errorf("The parameter %s is reserved", name)
+			}
+		}
+		return body, nil
+	case mediaType != "" && mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json"):
+		return body, nil
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(trimmed) == 0 && (r.Method == http.MethodGet || r.Method == http.MethodDelete):
+		return body, nil
+	case len(trimmed) == 0:
+		trimmed = []byte("{}")
+	case trimmed[0] != '{':
+		return body, nil
+	}
+
+	object, err := decodeParams(bytes.NewReader(trimmed))
+	if err != nil {
+		return webActionBody{}, err
+	}
+	if err := checkReservedParams(cfg, object); err != nil {
+		return webActionBody{}, err
+	}
+	for name, value := range params {
+		object[name] = value
+	}
+	body.data, err = json.Marshal(object)
+	if err != nil {
+		return webActionBody{}, err
+	}
+	if body.contentType == "" {
+		body.contentType = "application/json"
+	}
+	body.withParams = true
+	return body, nil
+}
+
+// webParamsHeader carries the stream parameters of a web action as a JSON
+// object when they could not be merged into its body, so that they are not
+// in the URL, where they could end up in the access logs.
+const webParamsHeader = "X-Stream-Params"
+
+// newWebActionRequest prepares the request invoking the web action at url
+// like the client request r: with the same method, query string, body and
+// allowlisted headers. The stream parameters are in the webParamsHeader
+// when they could not be merged into the body.
+func newWebActionRequest(r *http.Request, cfg *Config, url string, body webActionBody, params map[string]interface{}) (*http.Request, error) {
+	query := r.URL.Query()
+	// the parameters of the streamer are not for the action
+	query.Del("policy")
+
+	if len(query) > 0 {
+		url += "?" + query.Encode()
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", bodyReader.Len()))
-	req.ContentLength = int64(bodyReader.Len())
+	var reader io.Reader
+	if len(body.data) > 0 {
+		reader = bytes.NewReader(body.data)
+	}
+	req, err := http.NewRequest(r.Method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body.contentType != "" {
+		req.Header.Set("Content-Type", body.contentType)
+	}
+	for _, name := range cfg.WebHeaders {
+		if http.CanonicalHeaderKey(name) == "X-Forwarded-For" {
+			// the client could send any address, the one it connected
+			// from is appended as a proxy does
+			req.Header.Set(name, forwardedFor(r))
+			continue
+		}
+		for _, value := range r.Header.Values(name) {
+			req.Header.Add(name, value)
+		}
+	}
+
+	// only the streamer gives the stream parameters
+	req.Header.Del(webParamsHeader)
+	if !body.withParams {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(webParamsHeader, string(data))
+	}
+	return req, nil
+}
+
+// forwardedFor returns the X-Forwarded-For header of the client request r
+// with the address of the client appended.
+func forwardedFor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return strings.Join(append(r.Header.Values("X-Forwarded-For"), host), ", ")
+}
+
+func asyncInvokeWebAction(errChan chan error, activationIds chan<- string, req *http.Request) {
+	defer close(activationIds)
 
 	client := &http.Client{}
 	httpResp, err := client.Do(req)
@@ -130,6 +266,8 @@ func asyncPostWebAction(errChan chan error, url string, body []byte) {
 		errChan <- err
 		return
 	}
+	httpResp.Body.Close()
+	activationIds <- httpResp.Header.Get("X-Openwhisk-Activation-Id")
 
 	if httpResp.StatusCode != http.StatusOK {
 		errChan <- fmt.Errorf("Error invoking action: %s", httpResp.Status)
@@ -18,19 +18,27 @@
 package handlers
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/apache/openserverless-streaming-proxy/stream"
 	"github.com/stretchr/testify/require"
 )
 
-func TestAsyncPostWebAction(t *testing.T) {
+func TestAsyncInvokeWebAction(t *testing.T) {
 	tests := []struct {
 		name           string
 		url            string
 		body           []byte
 		expectedErrMsg string
+		activationId   string
 		handler        http.HandlerFunc
 	}{
 		{
@@ -38,14 +46,16 @@ func TestAsyncPostWebAction(t *testing.T) {
 			url:  "/success",
 			body: []byte(`{"key": "value"}`),
 			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("x-openwhisk-activation-id", "a1b2c3")
 				w.WriteHeader(http.StatusOK)
 			},
+			activationId: "a1b2c3",
 		},
 		{
-			name:           "Error in request creation",
-			url:            "://invalid-url",
+			name:           "Error in request",
+			url:            "http://localhost:0/unreachable",
 			body:           []byte(`{"key": "value"}`),
-			expectedErrMsg: "parse \"://invalid-url\": missing protocol scheme",
+			expectedErrMsg: "connect",
 		},
 		{
 			name: "Non-200 status code",
@@ -68,9 +78,14 @@ func TestAsyncPostWebAction(t *testing.T) {
 				tt.url = server.URL + tt.url
 			}
 
-			go asyncPostWebAction(errChan, tt.url, tt.body)
+			req, err := http.NewRequest("POST", tt.url, bytes.NewReader(tt.body))
+			require.NoError(t, err)
 
-			err := <-errChan
+			activationIds := make(chan string, 1)
+			go asyncInvokeWebAction(errChan, activationIds, req)
+
+			err = <-errChan
+			require.Equal(t, tt.activationId, <-activationIds)
 			if tt.expectedErrMsg != "" {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), tt.expectedErrMsg)
@@ -80,3 +95,264 @@ func TestAsyncPostWebAction(t *testing.T) {
 		})
 	}
 }
+
+func TestWebActionStreamHandler(t *testing.T) {
+	cfg := &Config{Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+
+	// the web action streams its greeting, then replies with its activation
+	// id; OpenWhisk gives a text body as __ow_body
+	ow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := make(map[string]interface{})
+		data, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") == "text/plain" {
+			params["__ow_body"] = string(data)
+		} else {
+			json.Unmarshal(data, &params)
+		}
+		for name := range r.URL.Query() {
+			params[name] = r.URL.Query().Get(name)
+		}
+		if header := r.Header.Get("X-Stream-Params"); header != "" {
+			json.Unmarshal([]byte(header), &params)
+		}
+		session, _ := params["STREAM_SESSION"].(string)
+		sess, ok := cfg.Sessions.Get(session)
+		if r.URL.Path != "/api/v1/web/ns1/default/hello" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		sess.Send(stream.Message{Data: fmt.Sprintf("%s %v %v", r.Method, params["name"], params["__ow_body"])})
+		sess.Send(stream.EndMessage(stream.Trailer{}))
+		w.Header().Set("x-openwhisk-activation-id", "a1b2c3")
+	}))
+	defer ow.Close()
+	cfg.ApiHost = ow.URL
+
+	router := http.NewServeMux()
+	router.HandleFunc("GET /web/{ns}/{action}", WebActionStreamHandler(cfg))
+	router.HandleFunc("POST /web/{ns}/{action}", WebActionStreamHandler(cfg))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{name: "GET", method: "GET", expected: "GET ada <nil>"},
+		{name: "POST", method: "POST", expected: "POST ada <nil>"},
+		{name: "POST text", method: "POST", contentType: "text/plain", body: "hello", expected: "POST ada hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+"/web/ns1/hello?name=ada", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			// the activation id is known at the end of the stream only
+			session := resp.Header.Get("X-Stream-Session")
+			meta := fmt.Sprintf(`{"namespace":"ns1","action":"default/hello","session":"%s","start":"2024-05-01T12:00:00Z"}`, session)
+			activationMeta := fmt.Sprintf(`{"activationId":"a1b2c3","namespace":"ns1","action":"default/hello","session":"%s","start":"2024-05-01T12:00:00Z"}`, session)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, "event: meta\nid: 1\ndata: "+meta+"\n\nid: 2\ndata: "+tt.expected+"\n\nevent: meta\nid: 3\ndata: "+activationMeta+"\n\nevent: end\nid: 4\ndata: {}\n\n", string(body))
+		})
+	}
+
+	// the query string cannot carry the stream coordinates either
+	resp, err := http.Get(server.URL + "/web/ns1/hello?__ow_stream=spoofed")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestNewWebActionBody(t *testing.T) {
+	cfg := &Config{}
+	params := map[string]interface{}{"STREAM_SESSION": "s1"}
+
+	tests := []struct {
+		name           string
+		method         string
+		contentType    string
+		body           string
+		expected       webActionBody
+		expectedErrMsg string
+	}{
+		{
+			name:     "JSON object",
+			method:   "POST",
+			body:     `{"count": 2}`,
+			expected: webActionBody{data: []byte(`{"STREAM_SESSION":"s1","count":2}`), contentType: "application/json", withParams: true},
+		},
+		{
+			name:        "JSON object with its content type",
+			method:      "PUT",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"count": 2}`,
+			expected:    webActionBody{data: []byte(`{"STREAM_SESSION":"s1","count":2}`), contentType: "application/json; charset=utf-8", withParams: true},
+		},
+		{
+			name:     "Empty body",
+			method:   "POST",
+			expected: webActionBody{data: []byte(`{"STREAM_SESSION":"s1"}`), contentType: "application/json", withParams: true},
+		},
+		{
+			name:     "No body",
+			method:   "GET",
+			expected: webActionBody{data: []byte{}},
+		},
+		{
+			name:     "JSON array",
+			method:   "POST",
+			body:     `[1, 2]`,
+			expected: webActionBody{data: []byte(`[1, 2]`)},
+		},
+		{
+			name:        "Text",
+			method:      "POST",
+			contentType: "text/plain",
+			body:        "hello",
+			expected:    webActionBody{data: []byte("hello"), contentType: "text/plain"},
+		},
+		{
+			name:        "Binary",
+			method:      "PUT",
+			contentType: "image/png",
+			body:        "\x89PNG",
+			expected:    webActionBody{data: []byte("\x89PNG"), contentType: "image/png"},
+		},
+		{
+			name:        "Form",
+			method:      "POST",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "name=ada",
+			expected:    webActionBody{data: []byte("name=ada"), contentType: "application/x-www-form-urlencoded"},
+		},
+		{
+			name:           "Spoofed JSON object",
+			method:         "POST",
+			body:           `{"__ow_stream": {}}`,
+			expectedErrMsg: "The parameter __ow_stream is reserved",
+		},
+		{
+			name:           "Spoofed form",
+			method:         "POST",
+			contentType:    "application/x-www-form-urlencoded",
+			body:           "STREAM_TOKEN=secret",
+			expectedErrMsg: "The parameter STREAM_TOKEN is reserved",
+		},
+		{
+			name:           "Invalid content type",
+			method:         "POST",
+			contentType:    "text/",
+			expectedErrMsg: "Unsupported media type: text/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/web/ns1/hello", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			body, err := newWebActionBody(r, cfg, params)
+			if tt.expectedErrMsg != "" {
+				require.EqualError(t, err, tt.expectedErrMsg)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, body)
+		})
+	}
+}
+
+func TestNewWebActionRequest(t *testing.T) {
+	cfg := &Config{WebHeaders: []string{"Accept-Language", "Cookie", "X-Forwarded-For", "X-Stream-Params"}}
+	params := map[string]interface{}{"STREAM_SESSION": "s1", "count": 2.0}
+
+	tests := []struct {
+		name           string
+		method         string
+		target         string
+		body           webActionBody
+		forwardedFor   string
+		expectedQuery  url.Values
+		expectedParams string
+		expectedFor    string
+	}{
+		{
+			name:          "parameters in the body",
+			method:        "POST",
+			target:        "/web/ns1/hello?lang=go&policy=drop-oldest",
+			body:          webActionBody{data: []byte(`{"STREAM_SESSION":"s1","count":2}`), contentType: "application/json", withParams: true},
+			expectedQuery: url.Values{"lang": {"go"}},
+			expectedFor:   "192.0.2.1",
+		},
+		{
+			name:           "parameters in the header",
+			method:         "GET",
+			target:         "/web/ns1/hello?lang=go",
+			forwardedFor:   "10.0.0.1",
+			expectedQuery:  url.Values{"lang": {"go"}},
+			expectedParams: `{"STREAM_SESSION":"s1","count":2}`,
+			expectedFor:    "10.0.0.1, 192.0.2.1",
+		},
+		{
+			name:           "text body",
+			method:         "POST",
+			target:         "/web/ns1/hello",
+			body:           webActionBody{data: []byte("hello"), contentType: "text/plain"},
+			expectedQuery:  url.Values{},
+			expectedParams: `{"STREAM_SESSION":"s1","count":2}`,
+			expectedFor:    "192.0.2.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Header.Set("Accept-Language", "it-IT")
+			r.Header.Add("Cookie", "a=1")
+			r.Header.Add("Cookie", "b=2")
+			r.Header.Set("X-Private", "secret")
+			r.Header.Set("X-Stream-Params", `{"STREAM_SESSION":"spoofed"}`)
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+
+			req, err := newWebActionRequest(r, cfg, "http://ow/api/v1/web/ns1/default/hello", tt.body, params)
+			require.NoError(t, err)
+			require.Equal(t, tt.method, req.Method)
+			require.Equal(t, "/api/v1/web/ns1/default/hello", req.URL.Path)
+			require.Equal(t, tt.expectedQuery, req.URL.Query())
+
+			// only the allowlisted headers are forwarded, and the client
+			// can give neither its address nor the stream parameters
+			require.Equal(t, "it-IT", req.Header.Get("Accept-Language"))
+			require.Equal(t, []string{"a=1", "b=2"}, req.Header.Values("Cookie"))
+			require.Empty(t, req.Header.Get("X-Private"))
+			require.Equal(t, tt.expectedFor, req.Header.Get("X-Forwarded-For"))
+			require.Equal(t, tt.expectedParams, req.Header.Get("X-Stream-Params"))
+
+			if tt.body.data == nil {
+				require.Nil(t, req.Body)
+				return
+			}
+			// the body is forwarded with its content type
+			require.Equal(t, tt.body.contentType, req.Header.Get("Content-Type"))
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.body.data, body)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"golang.org/x/net/websocket"
+)
+
+// wsAuthParam is the field of the first message carrying the OpenWhisk key
+// of the clients that cannot set the Authorization header, like browsers.
+const wsAuthParam = "__ow_auth"
+
+// WebSocketActionHandler invokes an action like ActionStreamHandler, but
+// over a WebSocket: the client sends the action parameters as the first
+// message and receives every event as a JSON message. Any further message
+// of the client is sent to the action.
+func WebSocketActionHandler(cfg *Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace, actionToInvoke := getNamespaceAndAction(r)
+
+		log.Println(fmt.Sprintf("WebSocket Action request: %s (%s)", actionToInvoke, namespace))
+
+		if refuseWhileDraining(w, cfg) {
+			return
+		}
+
+		// without the header, the key comes with the first message
+		apiKey, _ := extractAuthToken(r)
+
+		server := websocket.Server{
+			// the OpenWhisk key is required and never sent by the browsers
+			// on their own, as cookies are, so the origin adds nothing to it
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				streamActionOverWebSocket(ws, cfg, apiKey, namespace, actionToInvoke)
+			},
+		}
+		server.ServeHTTP(w, r)
+	}
+}
+
+func streamActionOverWebSocket(ws *websocket.Conn, cfg *Config, apiKey, namespace, actionToInvoke string) {
+	defer ws.Close()
+
+	ctx, done := context.WithCancel(context.Background())
+	defer done()
+
+	// the first message carries the action parameters
+	var first []byte
+	if err := websocket.Message.Receive(ws, &first); err != nil {
+		log.Println("Error reading from WebSocket:", err)
+		return
+	}
+
+	params, err := decodeParams(bytes.NewReader(first))
+	if err != nil {
+		sendWebSocketError(ws, err)
+		return
+	}
+
+	// the key is never given to the action
+	if key, ok := params[wsAuthParam]; ok {
+		delete(params, wsAuthParam)
+		if s, ok := key.(string); ok && apiKey == "" {
+			apiKey = strings.TrimPrefix(s, "Bearer ")
+		}
+	}
+	if apiKey == "" {
+		sendWebSocketError(ws, errors.New("Missing Authorization header or "+wsAuthParam+" field"))
+		return
+	}
+
+	client := NewOpenWhiskClient(cfg.ApiHost, apiKey, namespace)
+	// the activation is watched with a client of its own
+	watcher := newActivationWatcher(NewOpenWhiskClient(cfg.ApiHost, apiKey, namespace), false)
+
+	policy, err := getPolicy(ws.Request(), cfg)
+	if err != nil {
+		sendWebSocketError(ws, err)
+		return
+	}
+
+	// opens a session the action connects to
+	sess, err := cfg.Sessions.Open(ctx)
+	if err != nil {
+		sendWebSocketError(ws, err)
+		return
+	}
+	sess.Replay.SetPolicy(policy)
+
+	coords, err := getStreamCoordinates(ws.Request(), cfg, sess)
+	if err != nil {
+		sendWebSocketError(ws, err)
+		return
+	}
+	if err := injectStreamParams(params, cfg, coords); err != nil {
+		sendWebSocketError(ws, err)
+		return
+	}
+
+	// the result of the action closes the stream
+	sess.SetResult(watcher.result)
+
+	// invoke the action
+	activationId, err := invokeAction(client, actionToInvoke, params)
+	if err != nil {
+		sendWebSocketError(ws, err)
+		return
+	}
+	log.Println("Action invoked:", activationId)
+
+	meta := newStreamMeta(namespace, actionToInvoke, sess)
+	meta.ActivationID = activationId
+	openStream(sess, meta)
+	go watcher.watch(sess, activationId)
+
+	// relay the client messages to the action until the client goes away
+	go func() {
+		defer done()
+		for {
+			var data []byte
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				return
+			}
+			if err := sess.SendInput(ctx, stream.DataMessage(data)); err != nil {
+				return
+			}
+		}
+	}()
+
+	streamToWebSocket(ctx, ws, sess)
+}
+
+// streamToWebSocket subscribes the client to the stream of the session, like
+// relayStream, and sends every message as a JSON message until the end of
+// stream or ctx is done.
+func streamToWebSocket(ctx context.Context, ws *websocket.Conn, sess *stream.Session) {
+	sub, err := sess.Subscribe(0)
+	if err != nil {
+		sendWebSocketError(ws, err)
+		return
+	}
+	defer sub.Close()
+
+	for {
+		messages, changed, err := sub.Next()
+		if err == stream.ErrSlowClient {
+			log.Println("Disconnecting slow client of stream", sess.ID)
+			websocket.Message.Send(ws, string(stream.EncodeMessage(stream.DroppedMessage(stream.Dropped{Disconnected: true}))))
+			return
+		}
+
+		for _, msg := range messages {
+			if err := websocket.Message.Send(ws, string(stream.EncodeMessage(msg))); err != nil {
+				log.Println("Error writing to WebSocket:", err)
+				return
+			}
+		}
+		if len(messages) > 0 {
+			last := messages[len(messages)-1]
+			id, _ := strconv.ParseUint(last.ID, 10, 64)
+			sub.MarkRead(id)
+
+			if last.End {
+				log.Println("End of stream received, closing WebSocket")
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			log.Println("WebSocket client closed connection")
+			return
+		}
+	}
+}
+
+// sendWebSocketError reports an error to the client as an error event.
+func sendWebSocketError(ws *websocket.Conn, err error) {
+	log.Println(err.Error())
+	msg := stream.Message{Event: "error", Data: err.Error()}
+	websocket.Message.Send(ws, string(stream.EncodeMessage(msg)))
+}
@@ -0,0 +1,207 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/apache/openwhisk-client-go/whisk"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func dialAction(t *testing.T, cfg *Config, path string) *websocket.Conn {
+	return dialActionAuth(t, cfg, path, "Bearer user:pass")
+}
+
+// dialActionAuth dials the action with the given Authorization header, none
+// when empty.
+func dialActionAuth(t *testing.T, cfg *Config, path, auth string) *websocket.Conn {
+	router := http.NewServeMux()
+	router.HandleFunc("GET /ws/action/{ns}/{action}", WebSocketActionHandler(cfg))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	config, err := websocket.NewConfig(webSocketURL(server.URL)+path, server.URL)
+	require.NoError(t, err)
+	if auth != "" {
+		config.Header.Set("Authorization", auth)
+	}
+
+	ws, err := websocket.DialConfig(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.Close() })
+
+	ws.SetDeadline(time.Now().Add(2 * time.Second))
+	return ws
+}
+
+func TestWebSocketActionHandler(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+
+	ws := dialAction(t, cfg, "/ws/action/ns1/hello")
+	require.NoError(t, websocket.Message.Send(ws, `{"greeting": "hello"}`))
+
+	// play the action: echo the client input back, then end the stream
+	params := <-ow.invoked
+	require.Equal(t, "hello", params["greeting"])
+	require.Equal(t, "localhost", params["STREAM_HOST"])
+
+	sess, ok := cfg.Sessions.Get(params["STREAM_SESSION"].(string))
+	require.True(t, ok)
+	go func() {
+		sess.Send(stream.Message{Event: "ready"})
+		input := <-sess.Input
+		sess.Send(stream.Message{Data: "echo: " + input.Data})
+		sess.Send(stream.EndMessage(stream.Trailer{Status: "success"}))
+	}()
+
+	// the stream opens with the meta event, like the other streams
+	var reply string
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, strings.TrimSpace(metaEvent(formatNDJSON, sess.ID)), reply)
+
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, `{"event":"ready","id":"2","data":""}`, reply)
+
+	require.NoError(t, websocket.Message.Send(ws, "ping"))
+
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, `{"id":"3","data":"echo: ping"}`, reply)
+
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, `{"event":"result","id":"4","data":"{\"activationId\":\"a1b2c3\",\"status\":\"success\",\"success\":true,\"duration\":42,\"result\":{\"answer\":42}}"}`, reply)
+
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, `{"event":"end","id":"5","data":"{\"status\":\"success\"}"}`, reply)
+
+	// the stream is over, the WebSocket is closed
+	require.Error(t, websocket.Message.Receive(ws, &reply))
+}
+
+func TestWebSocketActionHandlerAuth(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		first       string
+		expectedKey string
+	}{
+		{
+			name:        "Authorization header",
+			header:      "Bearer user:pass",
+			first:       `{"greeting": "hello"}`,
+			expectedKey: "user:pass",
+		},
+		{
+			name:        "Key in the first message",
+			first:       `{"__ow_auth": "Bearer browser:key", "greeting": "hello"}`,
+			expectedKey: "browser:key",
+		},
+		{
+			name:        "Header over the first message",
+			header:      "Bearer user:pass",
+			first:       `{"__ow_auth": "browser:key", "greeting": "hello"}`,
+			expectedKey: "user:pass",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ow := newFakeOpenWhisk(t)
+			cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+
+			ws := dialActionAuth(t, cfg, "/ws/action/ns1/echo", tt.header)
+			require.NoError(t, websocket.Message.Send(ws, tt.first))
+
+			// the key is not a parameter of the action
+			params := <-ow.invoked
+			require.Equal(t, "hello", params["greeting"])
+			require.NotContains(t, params, "__ow_auth")
+			require.Equal(t, tt.expectedKey, <-ow.keys)
+		})
+	}
+
+	ow := newFakeOpenWhisk(t)
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry()}
+	ws := dialActionAuth(t, cfg, "/ws/action/ns1/echo", "")
+	require.NoError(t, websocket.Message.Send(ws, `{"greeting": "hello"}`))
+
+	var reply string
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, `{"event":"error","data":"Missing Authorization header or __ow_auth field"}`, reply)
+	require.Empty(t, ow.invoked)
+}
+
+func TestWebSocketActionHandlerInvalidParams(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry()}
+
+	ws := dialAction(t, cfg, "/ws/action/ns1/echo")
+	require.NoError(t, websocket.Message.Send(ws, `not json`))
+
+	var reply string
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Contains(t, reply, `"event":"error"`)
+	require.Empty(t, ow.invoked)
+}
+
+func TestWebSocketActionHandlerFailedActivation(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	ow.activation = &whisk.Activation{
+		ActivationID: "a1b2c3",
+		Response:     whisk.Response{Status: "application error", Result: map[string]interface{}{"error": "boom"}},
+	}
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+
+	ws := dialAction(t, cfg, "/ws/action/ns1/hello")
+	require.NoError(t, websocket.Message.Send(ws, `{}`))
+	params := <-ow.invoked
+
+	// the action crashed before connecting
+	var reply string
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, strings.TrimSpace(metaEvent(formatNDJSON, params["STREAM_SESSION"].(string))), reply)
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, `{"event":"error","id":"2","data":"{\"activationId\":\"a1b2c3\",\"status\":\"application error\",\"success\":false,\"duration\":0,\"result\":{\"error\":\"boom\"}}"}`, reply)
+	require.Error(t, websocket.Message.Receive(ws, &reply))
+}
+
+func TestWebSocketActionHandlerTimeout(t *testing.T) {
+	ow := newFakeOpenWhisk(t)
+	ow.activation = nil
+	cfg := &Config{ApiHost: ow.URL, Sessions: stream.NewRegistry(), StreamHost: "localhost", StreamPort: "8282"}
+	cfg.Sessions.Timeouts.Connect = 50 * time.Millisecond
+
+	ws := dialAction(t, cfg, "/ws/action/ns1/hello")
+	require.NoError(t, websocket.Message.Send(ws, `{}`))
+	params := <-ow.invoked
+
+	// the action never connects, the stream ends with a timeout
+	var reply string
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, strings.TrimSpace(metaEvent(formatNDJSON, params["STREAM_SESSION"].(string))), reply)
+	require.NoError(t, websocket.Message.Receive(ws, &reply))
+	require.Equal(t, `{"event":"timeout","id":"2","data":"{\"reason\":\"connect\",\"error\":\"the action did not connect within 50ms\"}"}`, reply)
+	require.Error(t, websocket.Message.Receive(ws, &reply))
+}
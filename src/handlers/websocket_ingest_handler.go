@@ -0,0 +1,146 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketIngestHandler lets an action push its stream over a WebSocket,
+// each message becoming one event. In ndjson mode, selected with the mode
+// query parameter, every message is a JSON message like the lines of the
+// ndjson protocol. The stream ends when the action closes the WebSocket.
+// The input of the client is sent back to the action on the same WebSocket.
+func WebSocketIngestHandler(cfg *Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := cfg.Sessions.Get(r.PathValue("session"))
+		if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+
+		token, err := extractAuthToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		mode := stream.ModeRaw
+		if name := r.URL.Query().Get("mode"); name != "" {
+			mode, err = stream.ParseMode(name)
+			if err != nil || mode == stream.ModeFramed {
+				http.Error(w, "Unsupported WebSocket mode: "+name, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := sess.Claim(token); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		server := websocket.Server{
+			// actions are not browsers, there is no origin to check
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				ws.MaxPayloadBytes = stream.MaxMessageSize
+				relayWebSocket(sess, ws, mode)
+			},
+		}
+		server.ServeHTTP(w, r)
+	}
+}
+
+func relayWebSocket(sess *stream.Session, ws *websocket.Conn, mode stream.Mode) {
+	defer ws.Close()
+	log.Println("New WebSocket ingress connection accepted!")
+
+	stop := context.AfterFunc(sess.StreamContext(), func() { ws.Close() })
+	defer stop()
+
+	ctx, cancel := context.WithCancel(sess.StreamContext())
+	defer cancel()
+	go sendInput(ctx, sess, ws, mode)
+
+	err := receiveMessages(sess, ws, mode)
+
+	// the stream ends when the action closes the WebSocket, unless it was
+	// already ended by a control message
+	switch {
+	case err == stream.ErrEnded || sess.StreamContext().Err() != nil:
+	case err == io.EOF:
+		sess.Send(stream.EndMessage(stream.Trailer{}))
+	default:
+		log.Println("Error reading from WebSocket", err)
+		sess.Send(stream.EndMessage(stream.Trailer{Status: "error", Error: err.Error()}))
+	}
+}
+
+func receiveMessages(sess *stream.Session, ws *websocket.Conn, mode stream.Mode) error {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return err
+		}
+
+		msg := stream.DataMessage(data)
+		if mode == stream.ModeNDJSON {
+			var err error
+			if msg, err = stream.DecodeMessage(data); err != nil {
+				log.Println("Skipping invalid WebSocket message:", err)
+				continue
+			}
+		} else if len(data) == 0 {
+			continue
+		}
+
+		if err := sess.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// sendInput writes the messages of the client to the action: the data as a
+// binary message in raw mode, a JSON message in ndjson mode.
+func sendInput(ctx context.Context, sess *stream.Session, ws *websocket.Conn, mode stream.Mode) {
+	for {
+		select {
+		case msg := <-sess.Input:
+			var err error
+			if mode == stream.ModeNDJSON {
+				err = websocket.Message.Send(ws, string(stream.EncodeMessage(msg)))
+			} else {
+				err = websocket.Message.Send(ws, []byte(msg.Data))
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("Error writing to WebSocket", err)
+				}
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
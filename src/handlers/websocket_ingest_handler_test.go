@@ -0,0 +1,150 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+// newIngestServer serves the WebSocket ingress for a single open session.
+func newIngestServer(t *testing.T, ctx context.Context) (*httptest.Server, *stream.Session) {
+	cfg := &Config{Sessions: stream.NewRegistry()}
+	sess, err := cfg.Sessions.Open(ctx)
+	require.NoError(t, err)
+
+	router := http.NewServeMux()
+	router.HandleFunc("GET /ingest/{session}", WebSocketIngestHandler(cfg))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	return server, sess
+}
+
+func dialIngest(server *httptest.Server, path string, token string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(webSocketURL(server.URL)+path, server.URL)
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set("Authorization", "Bearer "+token)
+	return websocket.DialConfig(config)
+}
+
+func receive(t *testing.T, sess *stream.Session, expected ...stream.Message) {
+	for _, msg := range expected {
+		select {
+		case receivedData := <-sess.Messages:
+			require.Equal(t, msg, receivedData)
+		case <-time.After(1 * time.Second):
+			require.Fail(t, "Timeout waiting for data")
+		}
+	}
+}
+
+func TestWebSocketIngestHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newIngestServer(t, ctx)
+
+	ws, err := dialIngest(server, "/ingest/"+sess.ID, sess.Token)
+	require.NoError(t, err)
+
+	go func() {
+		websocket.Message.Send(ws, "first message")
+		websocket.Message.Send(ws, []byte("second message"))
+		ws.Close()
+	}()
+
+	receive(t, sess,
+		stream.Message{Data: "first message"},
+		stream.Message{Data: "second message"},
+		stream.EndMessage(stream.Trailer{}),
+	)
+}
+
+func TestWebSocketIngestHandlerNDJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newIngestServer(t, ctx)
+
+	ws, err := dialIngest(server, "/ingest/"+sess.ID+"?mode=ndjson", sess.Token)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	go func() {
+		websocket.Message.Send(ws, `{"event": "token", "data": "hi"}`)
+		websocket.Message.Send(ws, `not json`)
+		websocket.Message.Send(ws, `{"control": "end", "status": "success"}`)
+	}()
+
+	receive(t, sess,
+		stream.Message{Event: "token", Data: "hi"},
+		stream.EndMessage(stream.Trailer{Status: "success"}),
+	)
+}
+
+func TestWebSocketIngestHandlerRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newIngestServer(t, ctx)
+
+	_, err := dialIngest(server, "/ingest/unknown", sess.Token)
+	require.Error(t, err)
+
+	_, err = dialIngest(server, "/ingest/"+sess.ID, "guess")
+	require.Error(t, err)
+
+	_, err = dialIngest(server, "/ingest/"+sess.ID+"?mode=framed", sess.Token)
+	require.Error(t, err)
+
+	// the token is accepted once
+	ws, err := dialIngest(server, "/ingest/"+sess.ID, sess.Token)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	_, err = dialIngest(server, "/ingest/"+sess.ID, sess.Token)
+	require.Error(t, err)
+}
+
+func TestWebSocketIngestHandlerInput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newIngestServer(t, ctx)
+
+	ws, err := dialIngest(server, "/ingest/"+sess.ID+"?mode=ndjson", sess.Token)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(2 * time.Second))
+
+	require.NoError(t, sess.SendInput(ctx, stream.Message{Event: "cancel", Data: "now"}))
+
+	var input string
+	require.NoError(t, websocket.Message.Receive(ws, &input))
+	require.Equal(t, `{"event":"cancel","data":"now"}`, input)
+}
@@ -18,28 +18,49 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/apache/openserverless-streaming-proxy/handlers"
 )
 
-func startHTTPServer(streamingProxyAddr string, apihost string) {
+// startHTTPServer serves the streams until ctx is done, then shuts down
+// gracefully: the new invocations are refused while the running streams
+// drain for up to drainTimeout, and the streams still running are closed.
+func startHTTPServer(ctx context.Context, cfg *handlers.Config, drainTimeout time.Duration) {
 	httpPort := os.Getenv("HTTP_SERVER_PORT")
 	if httpPort == "" {
 		httpPort = "80"
 	}
 
+	if cfg.StreamURL == "" {
+		cfg.StreamURL = "http://" + net.JoinHostPort(cfg.StreamHost, httpPort)
+	}
+
+	draining := make(chan struct{})
+	cfg.Draining = draining
+
 	router := http.NewServeMux()
 
 	router.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Streamer proxy running"))
 	})
-	router.HandleFunc("POST /web/{ns}/{action}", handlers.WebActionStreamHandler(streamingProxyAddr, apihost))
-	router.HandleFunc("POST /web/{ns}/{pkg}/{action}", handlers.WebActionStreamHandler(streamingProxyAddr, apihost))
-	router.HandleFunc("POST /action/{ns}/{action}", handlers.ActionStreamHandler(streamingProxyAddr, apihost))
-	router.HandleFunc("POST /action/{ns}/{pkg}/{action}", handlers.ActionStreamHandler(streamingProxyAddr, apihost))
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+		router.HandleFunc(method+" /web/{ns}/{action}", handlers.WebActionStreamHandler(cfg))
+		router.HandleFunc(method+" /web/{ns}/{pkg}/{action}", handlers.WebActionStreamHandler(cfg))
+	}
+	router.HandleFunc("POST /action/{ns}/{action}", handlers.ActionStreamHandler(cfg))
+	router.HandleFunc("POST /action/{ns}/{pkg}/{action}", handlers.ActionStreamHandler(cfg))
+	router.HandleFunc("GET /ws/action/{ns}/{action}", handlers.WebSocketActionHandler(cfg))
+	router.HandleFunc("GET /ws/action/{ns}/{pkg}/{action}", handlers.WebSocketActionHandler(cfg))
+	router.HandleFunc("GET /stream/{session}", handlers.SubscribeHandler(cfg))
+	router.HandleFunc("POST /session/{session}/input", handlers.InputHandler(cfg))
+	router.HandleFunc("POST /ingest/{session}", handlers.IngestHandler(cfg))
+	router.HandleFunc("GET /ingest/{session}", handlers.WebSocketIngestHandler(cfg))
 
 	server := &http.Server{
 		Addr:    ":" + httpPort,
@@ -47,7 +68,32 @@ func startHTTPServer(streamingProxyAddr string, apihost string) {
 	}
 
 	log.Println("HTTP server listening on port", httpPort)
-	if err := server.ListenAndServe(); err != nil {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errChan:
 		log.Println("Error starting HTTP server:", err)
+		return
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, draining", cfg.Sessions.Len(), "streams for up to", drainTimeout)
+	close(draining)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := cfg.Sessions.Drain(drainCtx); err != nil {
+		log.Println("Closing", cfg.Sessions.Len(), "streams still running")
+	}
+
+	// the handlers still relaying the end of the streams are given the
+	// rest of the deadline
+	if err := server.Shutdown(drainCtx); err != nil {
+		cfg.Sessions.CloseAll()
+		server.Close()
 	}
+	log.Println("HTTP server closed")
 }
@@ -17,7 +17,23 @@
 
 package main
 
-import "os"
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/handlers"
+	"github.com/apache/openserverless-streaming-proxy/stream"
+	"github.com/apache/openserverless-streaming-proxy/tcp"
+)
+
+// defaultDrainTimeout is how long the running streams can take to end on
+// shutdown, within the default grace period of a Kubernetes pod.
+const defaultDrainTimeout = 25 * time.Second
 
 func main() {
 	owApihost := os.Getenv("OW_APIHOST")
@@ -30,5 +46,129 @@ func main() {
 		panic("STREAMER_ADDR is not set")
 	}
 
-	startHTTPServer(streamerAddr, owApihost)
+	tcpPort := os.Getenv("STREAMER_TCP_PORT")
+	if tcpPort == "" {
+		tcpPort = "8282"
+	}
+
+	// a single TCP listener shared by all the streams
+	sessions := stream.NewRegistry()
+	if replaySize := os.Getenv("STREAMER_REPLAY_SIZE"); replaySize != "" {
+		size, err := strconv.Atoi(replaySize)
+		if err != nil || size < 1 {
+			panic("STREAMER_REPLAY_SIZE is not a valid number of messages")
+		}
+		sessions.ReplaySize = size
+	}
+	if replayBytes := os.Getenv("STREAMER_REPLAY_BYTES"); replayBytes != "" {
+		size, err := strconv.Atoi(replayBytes)
+		if err != nil || size < 0 {
+			panic("STREAMER_REPLAY_BYTES is not a valid number of bytes")
+		}
+		sessions.ReplayBytes = size
+	}
+	if readSize := os.Getenv("STREAMER_READ_SIZE"); readSize != "" {
+		size, err := strconv.Atoi(readSize)
+		if err != nil || size < 1 {
+			panic("STREAMER_READ_SIZE is not a valid number of bytes")
+		}
+		sessions.ReadSize = size
+	}
+	if policyName := os.Getenv("STREAMER_POLICY"); policyName != "" {
+		policy, err := stream.ParsePolicy(policyName)
+		if err != nil {
+			panic(err)
+		}
+		sessions.Policy = policy
+	}
+	if resumeGrace := os.Getenv("STREAMER_RESUME_GRACE"); resumeGrace != "" {
+		grace, err := time.ParseDuration(resumeGrace)
+		if err != nil || grace < 0 {
+			panic("STREAMER_RESUME_GRACE is not a valid duration")
+		}
+		sessions.Grace = grace
+	}
+	if detachedTTL := os.Getenv("STREAMER_DETACHED_TTL"); detachedTTL != "" {
+		ttl, err := time.ParseDuration(detachedTTL)
+		if err != nil || ttl < 0 {
+			panic("STREAMER_DETACHED_TTL is not a valid duration")
+		}
+		sessions.DetachedTTL = ttl
+	}
+	for name, timeout := range map[string]*time.Duration{
+		"STREAMER_CONNECT_TIMEOUT": &sessions.Timeouts.Connect,
+		"STREAMER_IDLE_TIMEOUT":    &sessions.Timeouts.Idle,
+		"STREAMER_MAX_DURATION":    &sessions.Timeouts.Total,
+	} {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				panic(name + " is not a valid duration")
+			}
+			*timeout = d
+		}
+	}
+	heartbeat := handlers.DefaultHeartbeat
+	if value := os.Getenv("STREAMER_HEARTBEAT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			panic("STREAMER_HEARTBEAT is not a valid duration")
+		}
+		heartbeat = d
+	}
+	webHeaders := handlers.DefaultWebHeaders
+	if value := os.Getenv("STREAMER_WEB_HEADERS"); value != "" {
+		webHeaders = nil
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				webHeaders = append(webHeaders, name)
+			}
+		}
+	}
+	omitLegacyParams := false
+	if value := os.Getenv("STREAMER_LEGACY_PARAMS"); value != "" {
+		legacy, err := strconv.ParseBool(value)
+		if err != nil {
+			panic("STREAMER_LEGACY_PARAMS is not a valid boolean")
+		}
+		omitLegacyParams = !legacy
+	}
+	drainTimeout := defaultDrainTimeout
+	if value := os.Getenv("STREAMER_DRAIN_TIMEOUT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			panic("STREAMER_DRAIN_TIMEOUT is not a valid duration")
+		}
+		drainTimeout = d
+	}
+
+	// the TCP server is stopped once the streams are drained
+	tcpCtx, stopTCP := context.WithCancel(context.Background())
+	sock, err := tcp.SetupTcpServer(tcpCtx, streamerAddr, tcpPort, sessions)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	go func() {
+		// a second signal stops the streamer at once
+		<-ctx.Done()
+		stop()
+	}()
+
+	startHTTPServer(ctx, &handlers.Config{
+		ApiHost:    owApihost,
+		Sessions:   sessions,
+		StreamHost: sock.Host,
+		StreamPort: sock.Port,
+		StreamURL:  os.Getenv("STREAMER_URL"),
+		Heartbeat:  heartbeat,
+		WebHeaders: webHeaders,
+
+		StreamParam:      os.Getenv("STREAMER_STREAM_PARAM"),
+		OmitLegacyParams: omitLegacyParams,
+	}, drainTimeout)
+
+	stopTCP()
+	<-sock.Done()
 }
@@ -0,0 +1,91 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultReadSize is how many bytes a raw stream reads at most at once.
+const DefaultReadSize = 2048
+
+// defaultChunks serves the sessions opened outside of a registry.
+var defaultChunks = NewChunkPool(DefaultReadSize)
+
+// Chunk is what a single read of a raw stream returned. Its bytes live in a
+// buffer borrowed from a pool, which the next reads reuse once the chunk is
+// released: Message copies them in a message that owns its data.
+type Chunk struct {
+	buf  *[]byte
+	n    int
+	pool *ChunkPool
+}
+
+// Bytes returns the bytes read, valid until the chunk is released.
+func (c *Chunk) Bytes() []byte {
+	return (*c.buf)[:c.n]
+}
+
+// Message returns a data message with a copy of the bytes read.
+func (c *Chunk) Message() Message {
+	return DataMessage(c.Bytes())
+}
+
+// Release gives the buffer back to the pool. The chunk must not be used
+// afterwards.
+func (c *Chunk) Release() {
+	if c.buf != nil {
+		c.pool.pool.Put(c.buf)
+		c.buf = nil
+	}
+}
+
+// ChunkPool reads the chunks of raw streams in buffers of the same size,
+// reused across reads and streams.
+type ChunkPool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewChunkPool(size int) *ChunkPool {
+	size = max(size, 1)
+	p := &ChunkPool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Size returns how many bytes a chunk holds at most.
+func (p *ChunkPool) Size() int {
+	return p.size
+}
+
+// Read reads a chunk, returning nil when nothing was read. Like io.Reader,
+// it can return both a chunk and an error.
+func (p *ChunkPool) Read(r io.Reader) (*Chunk, error) {
+	buf := p.pool.Get().(*[]byte)
+	n, err := r.Read(*buf)
+	if n == 0 {
+		p.pool.Put(buf)
+		return nil, err
+	}
+	return &Chunk{buf: buf, n: n, pool: p}, err
+}
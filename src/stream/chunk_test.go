@@ -0,0 +1,142 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkPool(t *testing.T) {
+	pool := NewChunkPool(4)
+	r := strings.NewReader("hello world")
+
+	// the messages keep their data while the buffers are reused
+	var messages []Message
+	for {
+		chunk, err := pool.Read(r)
+		if chunk != nil {
+			require.LessOrEqual(t, len(chunk.Bytes()), pool.Size())
+			messages = append(messages, chunk.Message())
+			chunk.Release()
+		}
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []Message{{Data: "hell"}, {Data: "o wo"}, {Data: "rld"}}, messages)
+}
+
+func TestChunkRelease(t *testing.T) {
+	pool := NewChunkPool(8)
+
+	chunk, err := pool.Read(strings.NewReader("first"))
+	require.NoError(t, err)
+	msg := chunk.Message()
+	buf := chunk.Bytes()
+	chunk.Release()
+	chunk.Release()
+
+	// overwrite the released buffer, as the next read would do
+	copy(buf[:cap(buf)], "XXXXXXXX")
+	require.Equal(t, "first", msg.Data)
+
+	chunk, err = pool.Read(strings.NewReader(""))
+	require.Nil(t, chunk)
+	require.Equal(t, io.EOF, err)
+}
+
+// TestRelayRawConcurrent relays many raw streams at once, with small reads
+// sharing the buffers of one pool, and keeps every message until all the
+// streams are over: none of them can change meanwhile.
+func TestRelayRawConcurrent(t *testing.T) {
+	registry := NewRegistry()
+	registry.ReadSize = 7
+
+	type result struct {
+		expected string
+		messages []Message
+		err      error
+	}
+	results := make(chan result, 50)
+
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sess, err := registry.Open(ctx)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+
+			var expected bytes.Buffer
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(&expected, "stream %d line %d\n", i, j)
+			}
+
+			pr, pw := io.Pipe()
+			go func() {
+				data := expected.Bytes()
+				for len(data) > 0 {
+					n := min(len(data), 13)
+					pw.Write(data[:n])
+					data = data[n:]
+				}
+				pw.Close()
+			}()
+
+			relayed := make(chan error, 1)
+			go func() {
+				relayed <- relayRaw(sess, pr)
+			}()
+
+			res := result{expected: expected.String()}
+			for {
+				select {
+				case msg := <-sess.Messages:
+					res.messages = append(res.messages, msg)
+					continue
+				case res.err = <-relayed:
+				}
+				break
+			}
+			results <- res
+		}()
+	}
+
+	for i := 0; i < cap(results); i++ {
+		res := <-results
+		require.Equal(t, io.EOF, res.err)
+
+		var received strings.Builder
+		for _, msg := range res.messages {
+			require.LessOrEqual(t, len(msg.Data), registry.ReadSize)
+			received.WriteString(msg.Data)
+		}
+		require.Equal(t, res.expected, received.String())
+	}
+}
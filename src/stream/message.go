@@ -0,0 +1,162 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Message is a single event relayed from an action to the HTTP client.
+type Message struct {
+	// Event is the event type, empty for plain data events.
+	Event string
+	// ID is the event id, if the action assigned one.
+	ID string
+	// Data is the event payload.
+	Data string
+	// Retry is the reconnection time in milliseconds, 0 when not set.
+	Retry int
+	// End marks the last message of the stream.
+	End bool
+}
+
+// Trailer is the final status an action can attach to the end of its stream.
+type Trailer struct {
+	Status string          `json:"status,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// EndMessage returns the message terminating a stream, an "end" event
+// carrying the trailer as JSON.
+func EndMessage(t Trailer) Message {
+	data, err := json.Marshal(t)
+	if err != nil {
+		data = []byte("{}")
+	}
+	return Message{Event: "end", Data: string(data), End: true}
+}
+
+// DataMessage wraps a chunk of bytes read from the action in a plain data event.
+func DataMessage(data []byte) Message {
+	return Message{Data: string(data)}
+}
+
+// Dropped tells a client about the messages it missed because it was too
+// slow to read them.
+type Dropped struct {
+	Count        uint64 `json:"count,omitempty"`
+	Disconnected bool   `json:"disconnected,omitempty"`
+}
+
+// DroppedMessage returns the "dropped" event reporting the missed messages.
+func DroppedMessage(d Dropped) Message {
+	data, err := json.Marshal(d)
+	if err != nil {
+		data = []byte("{}")
+	}
+	return Message{Event: "dropped", Data: string(data)}
+}
+
+type jsonMessage struct {
+	Event string          `json:"event"`
+	ID    string          `json:"id"`
+	Data  json.RawMessage `json:"data"`
+	Retry int             `json:"retry"`
+
+	Control string          `json:"control"`
+	Status  string          `json:"status"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// EncodeMessage returns the JSON object of a message, with the same fields
+// accepted by DecodeMessage. The end of stream carries its trailer as data.
+func EncodeMessage(msg Message) []byte {
+	jm := struct {
+		Event string `json:"event,omitempty"`
+		ID    string `json:"id,omitempty"`
+		Data  string `json:"data"`
+		Retry int    `json:"retry,omitempty"`
+	}{msg.Event, msg.ID, msg.Data, msg.Retry}
+
+	data, err := json.Marshal(jm)
+	if err != nil {
+		return []byte("{}")
+	}
+	return data
+}
+
+// DecodeMessage parses a JSON object with the optional fields event, id,
+// data and retry. A string data is used as it is, any other JSON value is
+// relayed as its JSON text.
+//
+// An object with the control field set to "end" is a control message
+// ending the stream, its optional status and result fields are relayed in
+// the trailer.
+func DecodeMessage(line []byte) (Message, error) {
+	var jm jsonMessage
+	if err := json.Unmarshal(line, &jm); err != nil {
+		return Message{}, err
+	}
+
+	switch jm.Control {
+	case "":
+	case "end":
+		return EndMessage(Trailer{Status: jm.Status, Result: jm.Result}), nil
+	default:
+		return Message{}, fmt.Errorf("unknown control message %q", jm.Control)
+	}
+
+	if strings.ContainsAny(jm.Event, "\r\n") || strings.ContainsAny(jm.ID, "\r\n") {
+		return Message{}, errors.New("event and id must not contain line breaks")
+	}
+	if jm.Retry < 0 {
+		return Message{}, errors.New("retry must not be negative")
+	}
+
+	msg := Message{Event: jm.Event, ID: jm.ID, Retry: jm.Retry}
+
+	data := bytes.TrimSpace(jm.Data)
+	switch {
+	case len(data) == 0 || bytes.Equal(data, []byte("null")):
+	case data[0] == '"':
+		if err := json.Unmarshal(data, &msg.Data); err != nil {
+			return Message{}, err
+		}
+	default:
+		msg.Data = string(data)
+	}
+
+	return msg, nil
+}
+
+// DecodeControl parses a control message, see DecodeMessage.
+func DecodeControl(payload []byte) (Message, error) {
+	msg, err := DecodeMessage(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	if !msg.End {
+		return Message{}, errors.New("not a control message")
+	}
+	return msg, nil
+}
@@ -0,0 +1,137 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		name           string
+		line           string
+		expected       Message
+		expectedErrMsg string
+	}{
+		{
+			name:     "String data",
+			line:     `{"data": "hello"}`,
+			expected: Message{Data: "hello"},
+		},
+		{
+			name:     "All fields",
+			line:     `{"event": "token", "id": "42", "data": "hi", "retry": 3000}`,
+			expected: Message{Event: "token", ID: "42", Data: "hi", Retry: 3000},
+		},
+		{
+			name:     "Object data",
+			line:     `{"event": "progress", "data": {"percent": 50}}`,
+			expected: Message{Event: "progress", Data: `{"percent": 50}`},
+		},
+		{
+			name:     "Number data",
+			line:     `{"data": 12}`,
+			expected: Message{Data: "12"},
+		},
+		{
+			name:     "No data",
+			line:     `{"event": "ping"}`,
+			expected: Message{Event: "ping"},
+		},
+		{
+			name:     "End control",
+			line:     `{"control": "end", "status": "success", "result": {"answer": 42}}`,
+			expected: Message{Event: "end", Data: `{"status":"success","result":{"answer":42}}`, End: true},
+		},
+		{
+			name:     "End control without trailer",
+			line:     `{"control": "end"}`,
+			expected: Message{Event: "end", Data: `{}`, End: true},
+		},
+		{
+			name:           "Unknown control",
+			line:           `{"control": "pause"}`,
+			expectedErrMsg: "unknown control message",
+		},
+		{
+			name:           "Invalid JSON",
+			line:           `{"data": "hello"`,
+			expectedErrMsg: "unexpected end of JSON input",
+		},
+		{
+			name:           "Not an object",
+			line:           `"hello"`,
+			expectedErrMsg: "cannot unmarshal",
+		},
+		{
+			name:           "Line break in event",
+			line:           `{"event": "a\nb"}`,
+			expectedErrMsg: "must not contain line breaks",
+		},
+		{
+			name:           "Negative retry",
+			line:           `{"retry": -1}`,
+			expectedErrMsg: "retry must not be negative",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := DecodeMessage([]byte(tt.line))
+			if tt.expectedErrMsg != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.expectedErrMsg)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, msg)
+		})
+	}
+}
+
+func TestDecodeControl(t *testing.T) {
+	msg, err := DecodeControl([]byte(`{"control": "end", "status": "error"}`))
+	require.NoError(t, err)
+	require.Equal(t, Message{Event: "end", Data: `{"status":"error"}`, End: true}, msg)
+
+	_, err = DecodeControl([]byte(`{"data": "hello"}`))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a control message")
+}
+
+func TestEndMessage(t *testing.T) {
+	msg := EndMessage(Trailer{Error: "connection reset"})
+	require.True(t, msg.End)
+	require.Equal(t, "end", msg.Event)
+	require.Equal(t, `{"error":"connection reset"}`, msg.Data)
+}
+
+func TestEncodeMessage(t *testing.T) {
+	require.Equal(t, `{"data":"hello"}`, string(EncodeMessage(Message{Data: "hello"})))
+	require.Equal(t,
+		`{"event":"token","id":"3","data":"a\nb","retry":100}`,
+		string(EncodeMessage(Message{Event: "token", ID: "3", Data: "a\nb", Retry: 100})),
+	)
+
+	msg, err := DecodeMessage(EncodeMessage(Message{Event: "progress", Data: "50"}))
+	require.NoError(t, err)
+	require.Equal(t, Message{Event: "progress", Data: "50"}, msg)
+}
@@ -0,0 +1,54 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import "fmt"
+
+// Policy is what a stream does when its replay is full of messages a slow
+// client did not read yet. Every client chooses its own, see
+// Replay.slowPolicy for how they are combined.
+type Policy int
+
+const (
+	// PolicyBlock makes the action wait for the slow client.
+	PolicyBlock Policy = iota
+	// PolicyDropOldest drops the oldest message, which the slow client
+	// misses.
+	PolicyDropOldest
+	// PolicyDropNewest drops the new message, which every client misses,
+	// or the oldest one when another client waits for every message.
+	PolicyDropNewest
+	// PolicyDisconnect disconnects the slow client.
+	PolicyDisconnect
+)
+
+// ParsePolicy returns the policy with the given name.
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "block":
+		return PolicyBlock, nil
+	case "drop-oldest":
+		return PolicyDropOldest, nil
+	case "drop-newest":
+		return PolicyDropNewest, nil
+	case "disconnect":
+		return PolicyDisconnect, nil
+	default:
+		return PolicyBlock, fmt.Errorf("unsupported slow client policy %q", name)
+	}
+}
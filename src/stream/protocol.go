@@ -0,0 +1,282 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// An action selects how its output is split into messages by sending a
+// protocol header as the first line of the stream, e.g.
+//
+//	OSSTREAM/1 framed\n
+//
+// Streams that do not start with the header are read in raw mode.
+const (
+	protocolMagic   = "OSSTREAM/"
+	maxHeaderSize   = 128
+	controlFrameBit = 1 << 31
+)
+
+// ProtocolVersion is the version of the protocol header understood by the
+// streamer.
+const ProtocolVersion = "1"
+
+// MaxMessageSize is the largest frame, line or message accepted from an
+// action.
+const MaxMessageSize = 1 << 20
+
+// Mode is how the output of an action is split into messages.
+type Mode int
+
+const (
+	// ModeRaw relays whatever a single read returns.
+	ModeRaw Mode = iota
+	// ModeFramed relays length prefixed frames: a 4 byte big endian
+	// length followed by the payload. The most significant bit of the
+	// length marks a control frame, see DecodeControl.
+	ModeFramed
+	// ModeNDJSON relays newline delimited JSON objects, see
+	// DecodeMessage for the accepted fields.
+	ModeNDJSON
+)
+
+// NegotiateProtocol looks for the protocol header at the start of the
+// stream and consumes it when present. Bytes that are not part of a header
+// are left in the reader.
+func NegotiateProtocol(r *bufio.Reader) (Mode, error) {
+	for i := 1; i <= len(protocolMagic); i++ {
+		peek, err := r.Peek(i)
+		if err != nil {
+			if len(peek) > 0 {
+				// too short to be a header, leave it to the raw relay
+				return ModeRaw, nil
+			}
+			return ModeRaw, err
+		}
+		if peek[i-1] != protocolMagic[i-1] {
+			return ModeRaw, nil
+		}
+	}
+
+	header, err := ReadHeaderLine(r)
+	if err != nil {
+		return ModeRaw, err
+	}
+	return parseProtocolHeader(header)
+}
+
+// ReadHeaderLine reads a line of at most maxHeaderSize bytes, trimming the
+// surrounding white space.
+func ReadHeaderLine(r *bufio.Reader) (string, error) {
+	header := make([]byte, 0, maxHeaderSize)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			return strings.TrimSpace(string(header)), nil
+		}
+		if len(header) == maxHeaderSize {
+			return "", fmt.Errorf("header line longer than %d bytes", maxHeaderSize)
+		}
+		header = append(header, b)
+	}
+}
+
+func parseProtocolHeader(header string) (Mode, error) {
+	version, mode, _ := strings.Cut(strings.TrimPrefix(header, protocolMagic), " ")
+	if version != ProtocolVersion {
+		return ModeRaw, fmt.Errorf("unsupported protocol version %q", version)
+	}
+
+	return ParseMode(mode)
+}
+
+// ParseMode returns the mode with the given name.
+func ParseMode(name string) (Mode, error) {
+	switch name {
+	case "raw":
+		return ModeRaw, nil
+	case "framed":
+		return ModeFramed, nil
+	case "ndjson":
+		return ModeNDJSON, nil
+	default:
+		return ModeRaw, fmt.Errorf("unsupported protocol mode %q", name)
+	}
+}
+
+// readFrame reads a single length prefixed frame, reporting whether it is a
+// control frame.
+func readFrame(r io.Reader) ([]byte, bool, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, false, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	control := size&controlFrameBit != 0
+	size &^= controlFrameBit
+	if size > MaxMessageSize {
+		return nil, false, fmt.Errorf("frame of %d bytes exceeds the limit of %d bytes", size, MaxMessageSize)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, err
+	}
+	return frame, control, nil
+}
+
+// readLine reads a single line without its terminator. The last line of the
+// stream does not need to be terminated.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		fragment, err := r.ReadSlice('\n')
+		if len(line)+len(fragment) > MaxMessageSize {
+			return nil, fmt.Errorf("line exceeds the limit of %d bytes", MaxMessageSize)
+		}
+		line = append(line, fragment...)
+
+		switch err {
+		case bufio.ErrBufferFull:
+			continue
+		case nil:
+			return bytes.TrimRight(line, "\r\n"), nil
+		case io.EOF:
+			if len(line) > 0 {
+				return line, nil
+			}
+			return nil, err
+		default:
+			return nil, err
+		}
+	}
+}
+
+// Relay reads the messages written by an action in the given mode and sends
+// them to the session. It stops at the end of the input, returning io.EOF,
+// at the end of stream, returning ErrEnded, or on the first error.
+func Relay(sess *Session, r *bufio.Reader, mode Mode) error {
+	switch mode {
+	case ModeFramed:
+		return relayFrames(sess, r)
+	case ModeNDJSON:
+		return relayLines(sess, r)
+	default:
+		return relayRaw(sess, r)
+	}
+}
+
+// relayRaw sends whatever each read returns as a single message.
+func relayRaw(sess *Session, r io.Reader) error {
+	chunks := sess.chunks
+	if chunks == nil {
+		chunks = defaultChunks
+	}
+
+	for {
+		chunk, err := chunks.Read(r)
+		if chunk != nil {
+			msg := chunk.Message()
+			chunk.Release()
+			if err := sess.Send(msg); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// relayFrames sends every non empty frame as a single message.
+func relayFrames(sess *Session, r io.Reader) error {
+	for {
+		frame, control, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+
+		msg := DataMessage(frame)
+		if control {
+			if msg, err = DecodeControl(frame); err != nil {
+				return err
+			}
+		} else if len(frame) == 0 {
+			continue
+		}
+
+		if err := sess.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// relayLines sends every non empty line as a single message, skipping the
+// lines that are not valid messages.
+func relayLines(sess *Session, r *bufio.Reader) error {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		msg, err := DecodeMessage(line)
+		if err != nil {
+			log.Println("Skipping invalid NDJSON message:", err)
+			continue
+		}
+		if err := sess.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// WriteMessage writes a message to an action in the given mode: the data as
+// it is in raw mode, a frame in framed mode and a JSON line in ndjson mode.
+func WriteMessage(w io.Writer, msg Message, mode Mode) error {
+	var buf []byte
+	switch mode {
+	case ModeFramed:
+		buf = binary.BigEndian.AppendUint32(nil, uint32(len(msg.Data)))
+		buf = append(buf, msg.Data...)
+	case ModeNDJSON:
+		buf = append(EncodeMessage(msg), '\n')
+	default:
+		buf = []byte(msg.Data)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,202 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func frame(payload string) []byte {
+	buf := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func controlFrame(payload string) []byte {
+	buf := frame(payload)
+	buf[0] |= 0x80
+	return buf
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		name           string
+		input          string
+		expectedMode   Mode
+		expectedRest   string
+		expectedErrMsg string
+	}{
+		{
+			name:         "No header",
+			input:        "hello",
+			expectedMode: ModeRaw,
+			expectedRest: "hello",
+		},
+		{
+			name:         "Partial magic",
+			input:        "OSS is great",
+			expectedMode: ModeRaw,
+			expectedRest: "OSS is great",
+		},
+		{
+			name:         "Shorter than magic",
+			input:        "OSS",
+			expectedMode: ModeRaw,
+			expectedRest: "OSS",
+		},
+		{
+			name:         "Raw header",
+			input:        "OSSTREAM/1 raw\nhello",
+			expectedMode: ModeRaw,
+			expectedRest: "hello",
+		},
+		{
+			name:         "Framed header",
+			input:        "OSSTREAM/1 framed\r\nhello",
+			expectedMode: ModeFramed,
+			expectedRest: "hello",
+		},
+		{
+			name:         "NDJSON header",
+			input:        "OSSTREAM/1 ndjson\n{}",
+			expectedMode: ModeNDJSON,
+			expectedRest: "{}",
+		},
+		{
+			name:           "Unsupported version",
+			input:          "OSSTREAM/2 framed\n",
+			expectedErrMsg: "unsupported protocol version",
+		},
+		{
+			name:           "Unsupported mode",
+			input:          "OSSTREAM/1 morse\n",
+			expectedErrMsg: "unsupported protocol mode",
+		},
+		{
+			name:           "Header too long",
+			input:          "OSSTREAM/1 " + strings.Repeat("x", maxHeaderSize) + "\n",
+			expectedErrMsg: "header line longer than",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+
+			mode, err := NegotiateProtocol(r)
+			if tt.expectedErrMsg != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.expectedErrMsg)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedMode, mode)
+
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedRest, string(rest))
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	input := bytes.NewReader(bytes.Join([][]byte{
+		frame("first"),
+		frame("second message"),
+		controlFrame(`{"control": "end"}`),
+	}, nil))
+
+	data, control, err := readFrame(input)
+	require.NoError(t, err)
+	require.False(t, control)
+	require.Equal(t, "first", string(data))
+
+	data, control, err = readFrame(input)
+	require.NoError(t, err)
+	require.False(t, control)
+	require.Equal(t, "second message", string(data))
+
+	data, control, err = readFrame(input)
+	require.NoError(t, err)
+	require.True(t, control)
+	require.Equal(t, `{"control": "end"}`, string(data))
+
+	_, _, err = readFrame(input)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	input := bytes.NewReader(frame("truncated")[:8])
+
+	_, _, err := readFrame(input)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, MaxMessageSize+1)
+
+	_, _, err := readFrame(bytes.NewReader(header))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the limit")
+}
+
+func TestReadLine(t *testing.T) {
+	r := bufio.NewReaderSize(strings.NewReader("first\r\n"+strings.Repeat("x", 100)+"\nlast"), 16)
+
+	line, err := readLine(r)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(line))
+
+	// longer than the reader buffer
+	line, err = readLine(r)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("x", 100), string(line))
+
+	// not terminated
+	line, err = readLine(r)
+	require.NoError(t, err)
+	require.Equal(t, "last", string(line))
+
+	_, err = readLine(r)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestWriteMessage(t *testing.T) {
+	msg := Message{Event: "input", Data: "hello"}
+
+	var raw bytes.Buffer
+	require.NoError(t, WriteMessage(&raw, msg, ModeRaw))
+	require.Equal(t, "hello", raw.String())
+
+	var framed bytes.Buffer
+	require.NoError(t, WriteMessage(&framed, msg, ModeFramed))
+	require.Equal(t, frame("hello"), framed.Bytes())
+
+	var lines bytes.Buffer
+	require.NoError(t, WriteMessage(&lines, msg, ModeNDJSON))
+	require.Equal(t, `{"event":"input","data":"hello"}`+"\n", lines.String())
+}
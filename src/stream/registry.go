@@ -0,0 +1,152 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReplaySize is how many messages a session keeps by default.
+	DefaultReplaySize = 256
+	// DefaultReplayBytes is how much data a session keeps by default.
+	DefaultReplayBytes = 16 << 20
+	// DefaultGrace is how long a session waits by default for its client
+	// to reconnect.
+	DefaultGrace = 30 * time.Second
+	// DefaultDetachedTTL is how long a detached session waits by default
+	// for its first client.
+	DefaultDetachedTTL = time.Hour
+)
+
+// Registry keeps track of the open sessions, so that the connections
+// coming from the actions can be routed to the waiting HTTP handlers.
+type Registry struct {
+	// ReplaySize is how many messages each session keeps for the clients
+	// resuming the stream.
+	ReplaySize int
+	// ReplayBytes is how much data each session keeps, 0 for no limit.
+	ReplayBytes int
+	// Policy is what the sessions do by default when a client is too slow.
+	Policy Policy
+	// Grace is how long a session waits for its client to reconnect.
+	Grace time.Duration
+	// DetachedTTL is how long a detached session waits for its first
+	// client.
+	DetachedTTL time.Duration
+	// ReadSize is how many bytes a raw stream reads at most at once.
+	ReadSize int
+	// Timeouts bound how long each session waits for its action.
+	Timeouts Timeouts
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	chunks   *ChunkPool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		ReplaySize:  DefaultReplaySize,
+		ReplayBytes: DefaultReplayBytes,
+		Policy:      PolicyBlock,
+		Grace:       DefaultGrace,
+		DetachedTTL: DefaultDetachedTTL,
+		ReadSize:    DefaultReadSize,
+		Timeouts:    Timeouts{Connect: DefaultConnectTimeout},
+		sessions:    make(map[string]*Session),
+	}
+}
+
+// Open registers a new session, which is removed when it is closed or ctx
+// is done.
+func (r *Registry) Open(ctx context.Context) (*Session, error) {
+	s, err := newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.Replay = newReplay(r.ReplaySize, r.ReplayBytes, r.Policy)
+	s.grace = r.Grace
+	s.detached = r.DetachedTTL
+	s.timeouts = r.Timeouts
+
+	r.mu.Lock()
+	// the sessions share the read buffers
+	if r.chunks == nil || r.chunks.Size() != max(r.ReadSize, 1) {
+		r.chunks = NewChunkPool(r.ReadSize)
+	}
+	s.chunks = r.chunks
+	r.sessions[s.ID] = s
+	r.mu.Unlock()
+
+	context.AfterFunc(s.ctx, func() {
+		r.mu.Lock()
+		delete(r.sessions, s.ID)
+		r.mu.Unlock()
+	})
+
+	return s, nil
+}
+
+// Get returns the open session with the given id.
+func (r *Registry) Get(id string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// Len returns the number of open sessions.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.sessions)
+}
+
+// Drain waits for the streams of the open sessions to be over, or for ctx
+// to be done. No new session should be opened meanwhile.
+func (r *Registry) Drain(ctx context.Context) error {
+	r.mu.Lock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.Unlock()
+
+	for _, s := range sessions {
+		select {
+		case <-s.StreamContext().Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// CloseAll closes the open sessions.
+func (r *Registry) CloseAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.sessions {
+		s.Close()
+	}
+}
@@ -0,0 +1,82 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first, err := registry.Open(ctx)
+	require.NoError(t, err)
+	second, err := registry.Open(context.Background())
+	require.NoError(t, err)
+	require.NotEqual(t, first.ID, second.ID)
+	require.Equal(t, 2, registry.Len())
+
+	found, ok := registry.Get(first.ID)
+	require.True(t, ok)
+	require.Same(t, first, found)
+
+	_, ok = registry.Get("unknown")
+	require.False(t, ok)
+
+	// sessions are removed when their context is done
+	cancel()
+	require.Eventually(t, func() bool {
+		_, ok := registry.Get(first.ID)
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, registry.Len())
+}
+
+func TestRegistryDrain(t *testing.T) {
+	registry := NewRegistry()
+	ended, err := registry.Open(context.Background())
+	require.NoError(t, err)
+	running, err := registry.Open(context.Background())
+	require.NoError(t, err)
+
+	go ended.Record()
+	go running.Record()
+	require.NoError(t, ended.Send(Message{Data: "done"}))
+	require.ErrorIs(t, ended.Send(EndMessage(Trailer{})), ErrEnded)
+	require.NoError(t, running.Send(Message{Data: "working"}))
+
+	// the running stream holds the drain until the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, registry.Drain(ctx), context.DeadlineExceeded)
+
+	go running.Send(EndMessage(Trailer{}))
+	require.NoError(t, registry.Drain(context.Background()))
+
+	// the sessions are kept for their clients until they are closed
+	require.Equal(t, 2, registry.Len())
+	registry.CloseAll()
+	require.Eventually(t, func() bool {
+		return registry.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,341 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	// ErrMissed is returned by Subscribe when the messages following the
+	// given id are not kept anymore.
+	ErrMissed = errors.New("messages not kept anymore")
+	// ErrDropped is returned by Record when the message is dropped.
+	ErrDropped = errors.New("message dropped")
+	// ErrSlowClient is returned to a subscriber disconnected for being slow.
+	ErrSlowClient = errors.New("disconnected as a slow client")
+)
+
+// Replay numbers the messages of a stream and keeps the last ones, for the
+// subscribers to read them at their pace and to read them again when they
+// resume the stream. The messages read by every subscriber are dropped to
+// make room for new ones, and the policies of the slow subscribers say what
+// to do when it is full of messages they did not read. The policy of the
+// replay is the one of its new subscribers, and applies while it has none.
+type Replay struct {
+	mu          sync.Mutex
+	entries     []entry
+	size        int
+	bytes       int
+	maxBytes    int
+	policy      Policy
+	last        uint64
+	read        uint64
+	ended       bool
+	changed     chan struct{}
+	subscribers map[*Subscriber]struct{}
+}
+
+type entry struct {
+	seq uint64
+	msg Message
+}
+
+// newReplay returns a replay keeping up to size messages and maxBytes of
+// data, without a limit on the data when maxBytes is 0.
+func newReplay(size int, maxBytes int, policy Policy) *Replay {
+	// the message being read is kept at least
+	if size < 1 {
+		size = 1
+	}
+	return &Replay{
+		size:        size,
+		maxBytes:    maxBytes,
+		policy:      policy,
+		changed:     make(chan struct{}),
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+// SetPolicy changes the policy of the new subscribers, also applied when
+// the replay is full without subscribers.
+func (r *Replay) SetPolicy(policy Policy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.policy = policy
+}
+
+// Record numbers a message, overriding any id set by the action, and
+// keeps it. When the replay is full of messages some subscriber did not
+// read, it applies the policies of the slow subscribers, see slowPolicy:
+// it waits for the subscribers to read them or ctx to be done, drops the
+// oldest message, or drops the new one returning ErrDropped. The end of
+// stream is never dropped, the oldest message is in its place.
+func (r *Replay) Record(ctx context.Context, msg Message) (Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.full(msg) {
+		oldest := r.entries[0].seq
+		if oldest <= r.read {
+			r.evict()
+			continue
+		}
+
+		policy := r.slowPolicy(oldest)
+		if msg.End && policy == PolicyDropNewest {
+			policy = PolicyDropOldest
+		}
+
+		switch policy {
+		case PolicyDropNewest:
+			r.last++
+			return msg, ErrDropped
+		case PolicyBlock:
+			changed := r.changed
+			r.mu.Unlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				r.mu.Lock()
+				return msg, ctx.Err()
+			}
+			r.mu.Lock()
+		default:
+			r.evict()
+		}
+	}
+
+	r.last++
+	msg.ID = strconv.FormatUint(r.last, 10)
+	if msg.End {
+		r.ended = true
+	}
+
+	r.entries = append(r.entries, entry{seq: r.last, msg: msg})
+	r.bytes += len(msg.Data)
+	r.notify()
+	return msg, nil
+}
+
+// slowPolicy returns what to do with the replay full of messages, the
+// oldest one not read by some subscriber. The slow subscribers asking for
+// it are disconnected first, then the stream waits when any other one asks
+// for it. The new message is dropped when one asks for it and no subscriber
+// waits for every message, and the oldest one otherwise.
+func (r *Replay) slowPolicy(oldest uint64) Policy {
+	if len(r.subscribers) == 0 {
+		return r.policy
+	}
+
+	var block, dropNewest, waiting, disconnected bool
+	for s := range r.subscribers {
+		waiting = waiting || s.policy == PolicyBlock
+		if s.cursor >= oldest {
+			continue
+		}
+		switch s.policy {
+		case PolicyBlock:
+			block = true
+		case PolicyDropNewest:
+			dropNewest = true
+		case PolicyDisconnect:
+			s.disconnected = true
+			delete(r.subscribers, s)
+			disconnected = true
+		}
+	}
+	if disconnected {
+		r.updateRead()
+		r.notify()
+	}
+
+	switch {
+	case block:
+		return PolicyBlock
+	case dropNewest && !waiting:
+		return PolicyDropNewest
+	default:
+		return PolicyDropOldest
+	}
+}
+
+// Subscribe starts reading the stream after the message with the given id,
+// from the oldest message kept when id is 0. It returns ErrMissed when some
+// messages following the id are not kept anymore. The subscriber gets the
+// policy of the replay, see Subscriber.SetPolicy.
+func (r *Replay) Subscribe(id uint64) (*Subscriber, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == 0 {
+		id = r.first() - 1
+	}
+	if id > r.last || id+1 < r.first() {
+		return nil, ErrMissed
+	}
+
+	s := &Subscriber{replay: r, cursor: id, policy: r.policy}
+	r.subscribers[s] = struct{}{}
+	r.updateRead()
+	return s, nil
+}
+
+// Ended tells whether the end of stream was recorded.
+func (r *Replay) Ended() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ended
+}
+
+// full tells whether there is no room for the message.
+func (r *Replay) full(msg Message) bool {
+	if len(r.entries) == 0 {
+		return false
+	}
+	if len(r.entries) >= r.size {
+		return true
+	}
+	return r.maxBytes > 0 && r.bytes+len(msg.Data) > r.maxBytes
+}
+
+func (r *Replay) evict() {
+	r.bytes -= len(r.entries[0].msg.Data)
+	r.entries = r.entries[1:]
+}
+
+// first returns the id of the oldest message kept.
+func (r *Replay) first() uint64 {
+	if len(r.entries) == 0 {
+		return r.last + 1
+	}
+	return r.entries[0].seq
+}
+
+// updateRead moves the messages read by every subscriber. Without
+// subscribers, it stays where the last ones left it.
+func (r *Replay) updateRead() {
+	if len(r.subscribers) == 0 {
+		return
+	}
+
+	read := r.last
+	for s := range r.subscribers {
+		read = min(read, s.cursor)
+	}
+	if read != r.read {
+		r.read = read
+		r.notify()
+	}
+}
+
+func (r *Replay) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Subscriber reads the stream from its own cursor, and chooses what to do
+// when it is too slow with its own policy.
+type Subscriber struct {
+	replay       *Replay
+	cursor       uint64
+	policy       Policy
+	closed       bool
+	disconnected bool
+	onClose      func()
+}
+
+// Next returns the messages following the last one read, and a channel
+// closed when the next messages are recorded. The messages dropped before
+// being read are reported with a "dropped" message. It returns
+// ErrSlowClient when the subscriber was disconnected.
+func (s *Subscriber) Next() ([]Message, <-chan struct{}, error) {
+	r := s.replay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s.disconnected {
+		return nil, nil, ErrSlowClient
+	}
+
+	i := sort.Search(len(r.entries), func(i int) bool {
+		return r.entries[i].seq > s.cursor
+	})
+	if i == len(r.entries) {
+		return nil, r.changed, nil
+	}
+
+	var messages []Message
+	previous := s.cursor
+	for _, e := range r.entries[i:] {
+		if missed := e.seq - previous - 1; missed > 0 {
+			messages = append(messages, DroppedMessage(Dropped{Count: missed}))
+		}
+		messages = append(messages, e.msg)
+		previous = e.seq
+	}
+	return messages, r.changed, nil
+}
+
+// SetPolicy changes what to do when the subscriber is too slow.
+func (s *Subscriber) SetPolicy(policy Policy) {
+	r := s.replay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s.policy = policy
+	// a stream waiting for the subscriber may go on now
+	r.notify()
+}
+
+// MarkRead tells that the subscriber read the messages up to the given id,
+// so they can make room for new ones.
+func (s *Subscriber) MarkRead(id uint64) {
+	r := s.replay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id > s.cursor && !s.closed && !s.disconnected {
+		s.cursor = id
+		r.updateRead()
+	}
+}
+
+// Close stops the subscription.
+func (s *Subscriber) Close() {
+	r := s.replay
+	r.mu.Lock()
+	if s.closed {
+		r.mu.Unlock()
+		return
+	}
+	s.closed = true
+	delete(r.subscribers, s)
+	r.updateRead()
+	r.mu.Unlock()
+
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
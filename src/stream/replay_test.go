@@ -0,0 +1,385 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	replay := newReplay(3, 0, PolicyBlock)
+	ctx := context.Background()
+
+	reader, err := replay.Subscribe(0)
+	require.NoError(t, err)
+
+	// ids are assigned in order, overriding those of the action
+	msg, err := replay.Record(ctx, Message{ID: "x", Data: "a"})
+	require.NoError(t, err)
+	require.Equal(t, Message{ID: "1", Data: "a"}, msg)
+
+	// the messages read make room for the new ones
+	for i, data := range []string{"b", "c", "d", "e"} {
+		reader.MarkRead(uint64(i + 1))
+		_, err := replay.Record(ctx, Message{Data: data})
+		require.NoError(t, err)
+	}
+	reader.Close()
+
+	tests := []struct {
+		name     string
+		id       uint64
+		expected []Message
+		err      error
+	}{
+		{
+			name:     "All kept",
+			id:       0,
+			expected: []Message{{ID: "3", Data: "c"}, {ID: "4", Data: "d"}, {ID: "5", Data: "e"}},
+		},
+		{
+			name:     "After the last dropped",
+			id:       2,
+			expected: []Message{{ID: "3", Data: "c"}, {ID: "4", Data: "d"}, {ID: "5", Data: "e"}},
+		},
+		{
+			name:     "After a kept one",
+			id:       4,
+			expected: []Message{{ID: "5", Data: "e"}},
+		},
+		{
+			name: "Up to date",
+			id:   5,
+		},
+		{
+			name: "Dropped",
+			id:   1,
+			err:  ErrMissed,
+		},
+		{
+			name: "Not sent yet",
+			id:   6,
+			err:  ErrMissed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, err := replay.Subscribe(tt.id)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			defer sub.Close()
+
+			messages, _, err := sub.Next()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, messages)
+		})
+	}
+}
+
+func TestReplayWaitsForSubscribers(t *testing.T) {
+	replay := newReplay(1, 0, PolicyBlock)
+
+	fast, err := replay.Subscribe(0)
+	require.NoError(t, err)
+	slow, err := replay.Subscribe(0)
+	require.NoError(t, err)
+
+	_, err = replay.Record(context.Background(), Message{Data: "a"})
+	require.NoError(t, err)
+	fast.MarkRead(1)
+
+	// the replay is full of messages the slow subscriber did not read
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = replay.Record(ctx, Message{Data: "b"})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// until it reads them or leaves
+	slow.Close()
+	msg, err := replay.Record(context.Background(), Message{Data: "b"})
+	require.NoError(t, err)
+	require.Equal(t, "2", msg.ID)
+}
+
+func TestSubscriberNext(t *testing.T) {
+	replay := newReplay(10, 0, PolicyBlock)
+	sub, err := replay.Subscribe(0)
+	require.NoError(t, err)
+
+	messages, changed, err := sub.Next()
+	require.NoError(t, err)
+	require.Empty(t, messages)
+
+	// the channel tells when the next messages are recorded
+	go replay.Record(context.Background(), Message{Data: "a"})
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		require.Fail(t, "Timeout waiting for data")
+	}
+
+	messages, _, err = sub.Next()
+	require.NoError(t, err)
+	require.Equal(t, []Message{{ID: "1", Data: "a"}}, messages)
+
+	// the cursor moves once the messages are marked read
+	sub.MarkRead(1)
+	messages, _, err = sub.Next()
+	require.NoError(t, err)
+	require.Empty(t, messages)
+}
+
+func TestReplayEnded(t *testing.T) {
+	replay := newReplay(0, 0, PolicyBlock)
+	ctx := context.Background()
+
+	replay.Record(ctx, Message{Data: "a"})
+	require.False(t, replay.Ended())
+
+	// only the last message is kept
+	sub, err := replay.Subscribe(1)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	end, err := replay.Record(ctx, EndMessage(Trailer{}))
+	require.NoError(t, err)
+	require.Equal(t, "2", end.ID)
+	require.True(t, replay.Ended())
+
+	messages, _, err := sub.Next()
+	require.NoError(t, err)
+	require.Equal(t, []Message{end}, messages)
+}
+
+func TestReplayPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		maxBytes int
+		messages []string
+		expected []Message
+		err      error
+	}{
+		{
+			name:     "Drop oldest",
+			policy:   PolicyDropOldest,
+			messages: []string{"a", "b", "c"},
+			expected: []Message{
+				DroppedMessage(Dropped{Count: 1}),
+				{ID: "2", Data: "b"},
+				{ID: "3", Data: "c"},
+			},
+		},
+		{
+			name:     "Drop newest",
+			policy:   PolicyDropNewest,
+			messages: []string{"a", "b", "c"},
+			expected: []Message{
+				{ID: "1", Data: "a"},
+				{ID: "2", Data: "b"},
+			},
+		},
+		{
+			name:     "Disconnect",
+			policy:   PolicyDisconnect,
+			messages: []string{"a", "b", "c"},
+			err:      ErrSlowClient,
+		},
+		{
+			name:     "Data cap",
+			policy:   PolicyDropOldest,
+			maxBytes: 4,
+			messages: []string{"ab", "cd", "ef"},
+			expected: []Message{
+				DroppedMessage(Dropped{Count: 1}),
+				{ID: "2", Data: "cd"},
+				{ID: "3", Data: "ef"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := newReplay(2, tt.maxBytes, tt.policy)
+			ctx := context.Background()
+
+			slow, err := replay.Subscribe(0)
+			require.NoError(t, err)
+			fast, err := replay.Subscribe(0)
+			require.NoError(t, err)
+
+			for _, data := range tt.messages {
+				msg, err := replay.Record(ctx, Message{Data: data})
+				if err == ErrDropped {
+					continue
+				}
+				require.NoError(t, err)
+				id, _ := strconv.ParseUint(msg.ID, 10, 64)
+				fast.MarkRead(id)
+			}
+
+			messages, _, err := slow.Next()
+			require.ErrorIs(t, err, tt.err)
+			require.Equal(t, tt.expected, messages)
+		})
+	}
+}
+
+func TestReplayDropNewestEnd(t *testing.T) {
+	replay := newReplay(2, 0, PolicyDropNewest)
+	ctx := context.Background()
+
+	slow, err := replay.Subscribe(0)
+	require.NoError(t, err)
+
+	for _, data := range []string{"a", "b", "c"} {
+		replay.Record(ctx, Message{Data: data})
+	}
+
+	// the end of stream takes the place of the oldest message
+	end, err := replay.Record(ctx, EndMessage(Trailer{}))
+	require.NoError(t, err)
+	require.Equal(t, "4", end.ID)
+
+	messages, _, err := slow.Next()
+	require.NoError(t, err)
+	require.Equal(t, []Message{
+		DroppedMessage(Dropped{Count: 1}),
+		{ID: "2", Data: "b"},
+		DroppedMessage(Dropped{Count: 1}),
+		end,
+	}, messages)
+}
+
+func TestReplaySubscriberPolicies(t *testing.T) {
+	tests := []struct {
+		name         string
+		fastPolicy   Policy
+		slowPolicy   Policy
+		expectedFast []Message
+		expectedSlow []Message
+		err          error
+	}{
+		{
+			name:       "Audit logger with a slow browser",
+			fastPolicy: PolicyBlock,
+			slowPolicy: PolicyDisconnect,
+			expectedFast: []Message{
+				{ID: "1", Data: "a"}, {ID: "2", Data: "b"}, {ID: "3", Data: "c"},
+			},
+			err: ErrSlowClient,
+		},
+		{
+			name:       "Drop newest while another client waits",
+			fastPolicy: PolicyBlock,
+			slowPolicy: PolicyDropNewest,
+			expectedFast: []Message{
+				{ID: "1", Data: "a"}, {ID: "2", Data: "b"}, {ID: "3", Data: "c"},
+			},
+			expectedSlow: []Message{
+				DroppedMessage(Dropped{Count: 1}),
+				{ID: "2", Data: "b"},
+				{ID: "3", Data: "c"},
+			},
+		},
+		{
+			name:       "Drop newest for every client",
+			fastPolicy: PolicyDropOldest,
+			slowPolicy: PolicyDropNewest,
+			expectedFast: []Message{
+				{ID: "1", Data: "a"}, {ID: "2", Data: "b"},
+			},
+			expectedSlow: []Message{
+				{ID: "1", Data: "a"},
+				{ID: "2", Data: "b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the default policy of the replay would block the stream
+			replay := newReplay(2, 0, PolicyBlock)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			slow, err := replay.Subscribe(0)
+			require.NoError(t, err)
+			slow.SetPolicy(tt.slowPolicy)
+			fast, err := replay.Subscribe(0)
+			require.NoError(t, err)
+			fast.SetPolicy(tt.fastPolicy)
+
+			var received []Message
+			for _, data := range []string{"a", "b", "c"} {
+				msg, err := replay.Record(ctx, Message{Data: data})
+				if err == ErrDropped {
+					continue
+				}
+				require.NoError(t, err)
+				received = append(received, msg)
+				id, _ := strconv.ParseUint(msg.ID, 10, 64)
+				fast.MarkRead(id)
+			}
+			require.Equal(t, tt.expectedFast, received)
+
+			messages, _, err := slow.Next()
+			require.ErrorIs(t, err, tt.err)
+			require.Equal(t, tt.expectedSlow, messages)
+		})
+	}
+}
+
+func TestReplaySubscriberBlock(t *testing.T) {
+	replay := newReplay(1, 0, PolicyDisconnect)
+	ctx := context.Background()
+
+	audit, err := replay.Subscribe(0)
+	require.NoError(t, err)
+	audit.SetPolicy(PolicyBlock)
+	_, err = replay.Record(ctx, Message{Data: "a"})
+	require.NoError(t, err)
+
+	// the slow audit logger makes the stream wait, until it gives up on
+	// getting every message
+	recorded := make(chan error, 1)
+	go func() {
+		_, err := replay.Record(ctx, Message{Data: "b"})
+		recorded <- err
+	}()
+	select {
+	case <-recorded:
+		require.Fail(t, "The stream did not wait for the slow client")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	audit.SetPolicy(PolicyDropOldest)
+	require.NoError(t, <-recorded)
+	messages, _, err := audit.Next()
+	require.NoError(t, err)
+	require.Equal(t, []Message{DroppedMessage(Dropped{Count: 1}), {ID: "2", Data: "b"}}, messages)
+}
@@ -0,0 +1,383 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// inputBufferSize is how many client messages can wait for the action.
+const inputBufferSize = 16
+
+// resultTimeout is how long the result of the action is waited for at the
+// end of the stream.
+const resultTimeout = 10 * time.Second
+
+var (
+	// ErrEnded is returned by Send after the end of stream was sent.
+	ErrEnded = errors.New("stream ended")
+	// ErrInvalidToken is returned by Claim when the token does not match.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrAlreadyClaimed is returned by Claim when the token was already used.
+	ErrAlreadyClaimed = errors.New("token already used")
+)
+
+// Session connects the action writing a stream to the HTTP handler
+// relaying it. The action proves it owns the session with a one-time token,
+// while the clients prove they may read the stream with ReadToken, and the
+// client invoking the action proves it did with InputToken to send it
+// input: the session id alone is no secret, it ends up in URLs and logs.
+//
+// Messages carries the output of the action to the handler, while Input
+// carries the messages of the clients back to the action. The messages are
+// recorded in Replay, where every subscribed client reads them and can read
+// them again when it resumes the stream.
+type Session struct {
+	ID         string
+	Token      string
+	ReadToken  string
+	InputToken string
+	Messages   chan Message
+	Input      chan Message
+	Replay     *Replay
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	grace     time.Duration
+	detached  time.Duration
+	timeouts  Timeouts
+	chunks    *ChunkPool
+	mu        sync.Mutex
+	claimedBy claimKind
+	claimed   chan struct{}
+	result    func(ctx context.Context) (Message, error)
+
+	// the stream context is done once the stream ended, while the clients
+	// can still read it from the replay
+	streamCtx context.Context
+	endStream context.CancelFunc
+
+	// the clients reading the stream and the timer closing the session
+	// when none comes back
+	subscribers int
+	graceTimer  *time.Timer
+}
+
+type claimKind int
+
+const (
+	unclaimed claimKind = iota
+	claimedByConnection
+	claimedByRequests
+)
+
+func newSession(ctx context.Context) (*Session, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	readToken, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	inputToken, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	streamCtx, endStream := context.WithCancel(ctx)
+	return &Session{
+		ID:         id,
+		Token:      token,
+		ReadToken:  readToken,
+		InputToken: inputToken,
+		Messages:   make(chan Message),
+		Input:      make(chan Message, inputBufferSize),
+		Replay:     newReplay(0, 0, PolicyBlock),
+		ctx:        ctx,
+		cancel:     cancel,
+		claimed:    make(chan struct{}),
+		streamCtx:  streamCtx,
+		endStream:  endStream,
+	}, nil
+}
+
+// Context is done when the session is over.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// StreamContext is done when the stream is over for the action, because it
+// ended, timed out or the session is over.
+func (s *Session) StreamContext() context.Context {
+	return s.streamCtx
+}
+
+// Close ends the session.
+func (s *Session) Close() {
+	s.cancel()
+}
+
+// Record moves the messages of the action to the replay, where the clients
+// read them, until the end of stream or the session is over.
+//
+// Record enforces the timeouts of the session too: when the action does not
+// connect, stays silent or writes for too long, the stream ends with a
+// "timeout" event.
+func (s *Session) Record() {
+	defer s.endStream()
+
+	var connect, idle, total deadline
+	defer connect.stop()
+	defer idle.stop()
+	defer total.stop()
+	connect.reset(s.timeouts.Connect)
+	total.reset(s.timeouts.Total)
+
+	claimed := s.claimed
+	connected := func() {
+		claimed = nil
+		connect.stop()
+		idle.reset(s.timeouts.Idle)
+	}
+
+	for {
+		select {
+		case msg := <-s.Messages:
+			if msg.End {
+				s.recordResult()
+			}
+			msg, err := s.Replay.Record(s.ctx, msg)
+			if err == ErrDropped {
+				idle.reset(s.timeouts.Idle)
+				continue
+			}
+			if err != nil || msg.End {
+				return
+			}
+			idle.reset(s.timeouts.Idle)
+		case <-claimed:
+			connected()
+		case <-connect.C():
+			if s.isClaimed() {
+				connected()
+				continue
+			}
+			s.timeout(connectTimeout(s.timeouts.Connect))
+			return
+		case <-idle.C():
+			s.timeout(idleTimeout(s.timeouts.Idle))
+			return
+		case <-total.C():
+			s.timeout(durationTimeout(s.timeouts.Total))
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// SetResult sets the function fetching the result of the action, which is
+// recorded right before the end of stream sent by the action.
+func (s *Session) SetResult(result func(ctx context.Context) (Message, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.result = result
+}
+
+func (s *Session) recordResult() {
+	s.mu.Lock()
+	result := s.result
+	s.mu.Unlock()
+	if result == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, resultTimeout)
+	defer cancel()
+	msg, err := result(ctx)
+	if err != nil {
+		log.Println("Error fetching the result of stream", s.ID+":", err)
+		return
+	}
+	s.Replay.Record(s.ctx, msg)
+}
+
+func (s *Session) timeout(t Timeout) {
+	log.Println("Stream", s.ID, "timed out:", t.Error)
+	s.Replay.Record(s.ctx, TimeoutMessage(t))
+}
+
+// Claimed is closed once the action connected to the session.
+func (s *Session) Claimed() <-chan struct{} {
+	return s.claimed
+}
+
+func (s *Session) isClaimed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.claimedBy != unclaimed
+}
+
+// Subscribe adds a client reading the stream after the message with the
+// given id, see Replay.Subscribe. Once the stream has no subscribers, the
+// session waits for the grace period for a client to subscribe again, and
+// is closed otherwise.
+func (s *Session) Subscribe(id uint64) (*Subscriber, error) {
+	sub, err := s.Replay.Subscribe(id)
+	if err != nil {
+		return nil, err
+	}
+	sub.onClose = s.unsubscribed
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers++
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+		s.graceTimer = nil
+	}
+	return sub, nil
+}
+
+// Release starts the grace period of a stream nobody subscribed to yet.
+func (s *Session) Release() {
+	s.release(s.grace)
+}
+
+// Detach starts the retention period of a detached stream, which waits
+// longer than the grace period for its first client, as the client may
+// come back much later. Once a client subscribed, the grace period applies.
+func (s *Session) Detach() {
+	s.release(s.detached)
+}
+
+func (s *Session) release(wait time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subscribers == 0 && s.graceTimer == nil {
+		s.graceTimer = time.AfterFunc(wait, s.Close)
+	}
+}
+
+func (s *Session) unsubscribed() {
+	s.mu.Lock()
+	s.subscribers--
+	s.mu.Unlock()
+
+	s.Release()
+}
+
+// Claim checks the token presented by an action connecting to the session.
+// The connection claims the session for itself, so nobody else can attach
+// once the action did.
+func (s *Session) Claim(token string) error {
+	return s.claim(token, claimedByConnection)
+}
+
+// ClaimRequest checks the token presented with an HTTP request of the
+// action. The session can receive many requests, but no connection then.
+func (s *Session) ClaimRequest(token string) error {
+	return s.claim(token, claimedByRequests)
+}
+
+func (s *Session) claim(token string, by claimKind) error {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		return ErrInvalidToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.claimedBy == unclaimed {
+		s.claimedBy = by
+		close(s.claimed)
+		return nil
+	}
+	if s.claimedBy == by && by == claimedByRequests {
+		return nil
+	}
+	return ErrAlreadyClaimed
+}
+
+// CheckReadToken checks the token presented by a client subscribing to the
+// stream.
+func (s *Session) CheckReadToken(token string) error {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.ReadToken)) != 1 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// CheckInputToken checks the token presented by a client sending input to
+// the action.
+func (s *Session) CheckInputToken(token string) error {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.InputToken)) != 1 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// Send hands a message to the HTTP handler. It returns ErrEnded after
+// sending the end of stream and the context error when the stream is over.
+func (s *Session) Send(msg Message) error {
+	select {
+	case s.Messages <- msg:
+		if msg.End {
+			return ErrEnded
+		}
+		return nil
+	case <-s.streamCtx.Done():
+		return s.streamCtx.Err()
+	}
+}
+
+// SendInput hands a message of the client to the action, waiting while
+// the action is not reading. It returns the context error when either the
+// stream or the given context is over.
+func (s *Session) SendInput(ctx context.Context, msg Message) error {
+	select {
+	case s.Input <- msg:
+		return nil
+	case <-s.streamCtx.Done():
+		return s.streamCtx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
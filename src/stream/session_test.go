@@ -0,0 +1,240 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionClaim(t *testing.T) {
+	sess, err := newSession(context.Background())
+	require.NoError(t, err)
+	require.Len(t, sess.ID, 32)
+	require.Len(t, sess.Token, 32)
+
+	require.ErrorIs(t, sess.Claim("guess"), ErrInvalidToken)
+	require.NoError(t, sess.Claim(sess.Token))
+	require.ErrorIs(t, sess.Claim(sess.Token), ErrAlreadyClaimed)
+	require.ErrorIs(t, sess.ClaimRequest(sess.Token), ErrAlreadyClaimed)
+}
+
+func TestSessionClaimRequest(t *testing.T) {
+	sess, err := newSession(context.Background())
+	require.NoError(t, err)
+
+	require.ErrorIs(t, sess.ClaimRequest("guess"), ErrInvalidToken)
+	require.NoError(t, sess.ClaimRequest(sess.Token))
+	require.NoError(t, sess.ClaimRequest(sess.Token))
+	require.ErrorIs(t, sess.Claim(sess.Token), ErrAlreadyClaimed)
+}
+
+func TestSessionCheckInputToken(t *testing.T) {
+	sess, err := newSession(context.Background())
+	require.NoError(t, err)
+	require.Len(t, sess.InputToken, 32)
+	require.NotEqual(t, sess.Token, sess.InputToken)
+
+	require.ErrorIs(t, sess.CheckInputToken(""), ErrInvalidToken)
+	require.ErrorIs(t, sess.CheckInputToken(sess.Token), ErrInvalidToken)
+	require.NoError(t, sess.CheckInputToken(sess.InputToken))
+	require.NoError(t, sess.CheckInputToken(sess.InputToken))
+}
+
+func TestSessionCheckReadToken(t *testing.T) {
+	sess, err := newSession(context.Background())
+	require.NoError(t, err)
+	require.Len(t, sess.ReadToken, 32)
+	require.NotEqual(t, sess.Token, sess.ReadToken)
+	require.NotEqual(t, sess.InputToken, sess.ReadToken)
+
+	require.ErrorIs(t, sess.CheckReadToken(""), ErrInvalidToken)
+	require.ErrorIs(t, sess.CheckReadToken(sess.InputToken), ErrInvalidToken)
+	require.NoError(t, sess.CheckReadToken(sess.ReadToken))
+}
+
+func TestSessionSend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sess, err := newSession(ctx)
+	require.NoError(t, err)
+
+	go func() {
+		<-sess.Messages
+		<-sess.Messages
+	}()
+
+	require.NoError(t, sess.Send(Message{Data: "hello"}))
+	require.ErrorIs(t, sess.Send(EndMessage(Trailer{})), ErrEnded)
+
+	// nobody is reading anymore, Send must not block once the session is over
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	require.ErrorIs(t, sess.Send(Message{Data: "late"}), context.Canceled)
+}
+
+func TestSessionSendInput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sess, err := newSession(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, sess.SendInput(context.Background(), Message{Data: "hello"}))
+	require.Equal(t, Message{Data: "hello"}, <-sess.Input)
+
+	// the input is buffered up to a limit, then SendInput waits for the
+	// action or the end of the session
+	for i := 0; i < inputBufferSize; i++ {
+		require.NoError(t, sess.SendInput(context.Background(), Message{Data: "queued"}))
+	}
+	reqCtx, timeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer timeout()
+	require.ErrorIs(t, sess.SendInput(reqCtx, Message{Data: "late"}), context.DeadlineExceeded)
+
+	cancel()
+	require.ErrorIs(t, sess.SendInput(context.Background(), Message{Data: "late"}), context.Canceled)
+}
+
+func TestSessionSubscribe(t *testing.T) {
+	registry := NewRegistry()
+	registry.Grace = 50 * time.Millisecond
+	sess, err := registry.Open(context.Background())
+	require.NoError(t, err)
+
+	first, err := sess.Subscribe(0)
+	require.NoError(t, err)
+	second, err := sess.Subscribe(0)
+	require.NoError(t, err)
+
+	// the session is kept while a client reads the stream
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, sess.Context().Err())
+
+	// and closed after the grace period without clients
+	second.Close()
+	require.Eventually(t, func() bool {
+		return sess.Context().Err() != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionSubscribeWithinGrace(t *testing.T) {
+	registry := NewRegistry()
+	registry.Grace = 50 * time.Millisecond
+	sess, err := registry.Open(context.Background())
+	require.NoError(t, err)
+
+	// a stream nobody subscribed to yet waits for its first client
+	sess.Release()
+
+	// subscribing stops the grace period
+	sub, err := sess.Subscribe(0)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, sess.Context().Err())
+
+	sub.Close()
+	require.Eventually(t, func() bool {
+		return sess.Context().Err() != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionDetach(t *testing.T) {
+	registry := NewRegistry()
+	registry.Grace = 50 * time.Millisecond
+	registry.DetachedTTL = 300 * time.Millisecond
+	sess, err := registry.Open(context.Background())
+	require.NoError(t, err)
+
+	// a detached stream waits longer than the grace period for its
+	// first client
+	sess.Detach()
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, sess.Context().Err())
+
+	// then the grace period applies
+	sub, err := sess.Subscribe(0)
+	require.NoError(t, err)
+	sub.Close()
+	require.Eventually(t, func() bool {
+		return sess.Context().Err() != nil
+	}, 250*time.Millisecond, 10*time.Millisecond)
+
+	// nobody subscribing, the session is closed after the retention period
+	sess, err = registry.Open(context.Background())
+	require.NoError(t, err)
+	sess.Detach()
+	require.Eventually(t, func() bool {
+		return sess.Context().Err() != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   func(ctx context.Context) (Message, error)
+		expected []Message
+	}{
+		{
+			name: "result recorded before the end",
+			result: func(ctx context.Context) (Message, error) {
+				return Message{Event: "result", Data: `{"status":"success"}`}, nil
+			},
+			expected: []Message{
+				{ID: "1", Data: "hello"},
+				{Event: "result", ID: "2", Data: `{"status":"success"}`},
+				{Event: "end", ID: "3", Data: "{}", End: true},
+			},
+		},
+		{
+			name: "result not available",
+			result: func(ctx context.Context) (Message, error) {
+				return Message{}, context.DeadlineExceeded
+			},
+			expected: []Message{
+				{ID: "1", Data: "hello"},
+				{Event: "end", ID: "2", Data: "{}", End: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess, err := NewRegistry().Open(context.Background())
+			require.NoError(t, err)
+			defer sess.Close()
+			sess.SetResult(tt.result)
+
+			go func() {
+				sess.Send(Message{Data: "hello"})
+				sess.Send(EndMessage(Trailer{}))
+			}()
+			sess.Record()
+
+			sub, err := sess.Subscribe(0)
+			require.NoError(t, err)
+			defer sub.Close()
+			messages, _, err := sub.Next()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, messages)
+		})
+	}
+}
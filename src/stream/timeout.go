@@ -0,0 +1,105 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DefaultConnectTimeout is how long a session waits by default for its
+// action to connect.
+const DefaultConnectTimeout = time.Minute
+
+// The reasons of the timeouts cutting a stream short.
+const (
+	TimeoutConnect  = "connect"
+	TimeoutIdle     = "idle"
+	TimeoutDuration = "duration"
+)
+
+// Timeouts bound how long a session waits for its action. A zero duration
+// disables the timeout.
+type Timeouts struct {
+	// Connect is how long the action has to connect to the session.
+	Connect time.Duration
+	// Idle is how long the action can stay silent between two messages.
+	Idle time.Duration
+	// Total is how long the whole stream can last.
+	Total time.Duration
+}
+
+// Timeout tells the client why the stream was cut short.
+type Timeout struct {
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+func connectTimeout(d time.Duration) Timeout {
+	return Timeout{TimeoutConnect, fmt.Sprintf("the action did not connect within %s", d)}
+}
+
+func idleTimeout(d time.Duration) Timeout {
+	return Timeout{TimeoutIdle, fmt.Sprintf("the action sent nothing for %s", d)}
+}
+
+func durationTimeout(d time.Duration) Timeout {
+	return Timeout{TimeoutDuration, fmt.Sprintf("the stream lasted more than %s", d)}
+}
+
+// TimeoutMessage returns the "timeout" event terminating a stream the
+// action did not write in time.
+func TimeoutMessage(t Timeout) Message {
+	data, err := json.Marshal(t)
+	if err != nil {
+		data = []byte("{}")
+	}
+	return Message{Event: "timeout", Data: string(data), End: true}
+}
+
+// deadline is a timer that can be disabled, its channel is nil meanwhile.
+type deadline struct {
+	t *time.Timer
+}
+
+func (d *deadline) C() <-chan time.Time {
+	if d.t == nil {
+		return nil
+	}
+	return d.t.C
+}
+
+// reset restarts the timer for d, or disables it when d is not positive.
+func (d *deadline) reset(dur time.Duration) {
+	switch {
+	case dur <= 0:
+		d.stop()
+	case d.t == nil:
+		d.t = time.NewTimer(dur)
+	default:
+		d.t.Reset(dur)
+	}
+}
+
+func (d *deadline) stop() {
+	if d.t != nil {
+		d.t.Stop()
+		d.t = nil
+	}
+}
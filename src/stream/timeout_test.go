@@ -0,0 +1,127 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts Timeouts
+		action   func(sess *Session)
+		expected []Message
+	}{
+		{
+			name:     "action connecting in time",
+			timeouts: Timeouts{Connect: 50 * time.Millisecond},
+			action: func(sess *Session) {
+				sess.Claim(sess.Token)
+				time.Sleep(100 * time.Millisecond)
+				sess.Send(Message{Data: "hello"})
+				sess.Send(EndMessage(Trailer{}))
+			},
+			expected: []Message{
+				{ID: "1", Data: "hello"},
+				{Event: "end", ID: "2", Data: "{}", End: true},
+			},
+		},
+		{
+			name:     "action not connecting",
+			timeouts: Timeouts{Connect: 20 * time.Millisecond},
+			action:   func(sess *Session) {},
+			expected: []Message{
+				withID(TimeoutMessage(connectTimeout(20*time.Millisecond)), "1"),
+			},
+		},
+		{
+			name:     "silent action",
+			timeouts: Timeouts{Connect: time.Second, Idle: 50 * time.Millisecond},
+			action: func(sess *Session) {
+				sess.Claim(sess.Token)
+				sess.Send(Message{Data: "hello"})
+				time.Sleep(20 * time.Millisecond)
+				sess.Send(Message{Data: "world"})
+			},
+			expected: []Message{
+				{ID: "1", Data: "hello"},
+				{ID: "2", Data: "world"},
+				withID(TimeoutMessage(idleTimeout(50*time.Millisecond)), "3"),
+			},
+		},
+		{
+			name:     "action writing for too long",
+			timeouts: Timeouts{Idle: 80 * time.Millisecond, Total: 100 * time.Millisecond},
+			action: func(sess *Session) {
+				sess.Claim(sess.Token)
+				for sess.Send(Message{Data: "tick"}) == nil {
+					time.Sleep(60 * time.Millisecond)
+				}
+			},
+			expected: []Message{
+				{ID: "1", Data: "tick"},
+				{ID: "2", Data: "tick"},
+				withID(TimeoutMessage(durationTimeout(100*time.Millisecond)), "3"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewRegistry()
+			registry.Timeouts = tt.timeouts
+			sess, err := registry.Open(context.Background())
+			require.NoError(t, err)
+			defer sess.Close()
+
+			sub, err := sess.Subscribe(0)
+			require.NoError(t, err)
+			defer sub.Close()
+
+			go tt.action(sess)
+			sess.Record()
+
+			// the stream is over for the action, not for its clients
+			require.Error(t, sess.StreamContext().Err())
+			require.NoError(t, sess.Context().Err())
+
+			messages, _, err := sub.Next()
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, messages)
+		})
+	}
+}
+
+func withID(msg Message, id string) Message {
+	msg.ID = id
+	return msg
+}
+
+func TestTimeoutMessage(t *testing.T) {
+	msg := TimeoutMessage(idleTimeout(30 * time.Second))
+	require.Equal(t, Message{
+		Event: "timeout",
+		Data:  `{"reason":"idle","error":"the action sent nothing for 30s"}`,
+		End:   true,
+	}, msg)
+}
@@ -0,0 +1,248 @@
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build unix
+
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
+)
+
+const idleSessions = 5000
+
+// BenchmarkIdleSessions measures the CPU time spent by the streamer while
+// 5,000 actions, connected over loopback, sit idle in the middle of their
+// streams, for every 100ms of idleness: reading until the connection is
+// closed on cancellation, as the TCP server does, against polling the
+// context with a 100ms read deadline, as it used to.
+func BenchmarkIdleSessions(b *testing.B) {
+	sessions := idleSessionCount(b)
+
+	// every connection is logged
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	b.Run("Blocking", func(b *testing.B) {
+		benchmarkBlockingSessions(b, sessions)
+	})
+	b.Run("Polling", func(b *testing.B) {
+		benchmarkPollingSessions(b, sessions)
+	})
+}
+
+// idleSessionCount raises the limit of open files as far as allowed, each
+// session taking two, and scales the sessions down when it is too low.
+func idleSessionCount(b *testing.B) int {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		b.Fatal(err)
+	}
+	if limit.Cur < limit.Max {
+		raised := limit
+		raised.Cur = raised.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err == nil {
+			limit = raised
+		}
+	}
+
+	available := (int64(limit.Cur) - 100) / 2
+	if available >= idleSessions {
+		return idleSessions
+	}
+	if available < 1 {
+		b.Skipf("the limit of %d open files is too low", limit.Cur)
+	}
+	b.Logf("the limit of %d open files allows %d idle sessions instead of %d", limit.Cur, available, idleSessions)
+	return int(available)
+}
+
+// benchmarkBlockingSessions connects the actions to the TCP server with a
+// valid session and token.
+func benchmarkBlockingSessions(b *testing.B, n int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sessions := stream.NewRegistry()
+	sessions.Timeouts = stream.Timeouts{}
+	sessions.Grace = time.Hour
+	sock, err := SetupTcpServer(ctx, "127.0.0.1", "0", sessions)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	clients := make([]net.Conn, 0, n)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		client, sess := connectIdleAction(b, ctx, sessions, net.JoinHostPort(sock.Host, sock.Port))
+		clients = append(clients, client)
+
+		// the stream is running once the first message is recorded
+		sub, err := sess.Subscribe(0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			messages, changed, err := sub.Next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(messages) > 0 {
+				break
+			}
+			<-changed
+		}
+		sub.Close()
+	}
+
+	measureIdle(b)
+
+	cancel()
+	<-sock.Done()
+}
+
+// benchmarkPollingSessions connects the actions to a listener reading each
+// connection with pollingRead.
+func benchmarkPollingSessions(b *testing.B, n int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	read := make(chan struct{}, n)
+	done := make(chan struct{}, n)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				pollingRead(ctx, conn, read)
+				done <- struct{}{}
+			}()
+		}
+	}()
+
+	clients := make([]net.Conn, 0, n)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		clients = append(clients, client)
+		if _, err := fmt.Fprintf(client, "%032x %032x\nhello", i, i); err != nil {
+			b.Fatal(err)
+		}
+		<-read
+	}
+
+	measureIdle(b)
+
+	cancel()
+	for i := 0; i < n; i++ {
+		<-done
+	}
+}
+
+// measureIdle reports the CPU time spent for every 100ms of idleness.
+func measureIdle(b *testing.B) {
+	// let the connections settle before measuring
+	time.Sleep(200 * time.Millisecond)
+
+	b.ResetTimer()
+	start := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	b.ReportMetric(float64(cpuTime(b)-start)/float64(b.N), "cpu-ns/op")
+	b.StopTimer()
+}
+
+// connectIdleAction opens a session and connects to it like an action
+// writing its first message, then going silent.
+func connectIdleAction(b *testing.B, ctx context.Context, sessions *stream.Registry, addr string) (net.Conn, *stream.Session) {
+	sess, err := sessions.Open(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go sess.Record()
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(client, "%s %s\nhello", sess.ID, sess.Token); err != nil {
+		b.Fatal(err)
+	}
+	return client, sess
+}
+
+// pollingRead reads with a short deadline, checking ctx on every timeout,
+// and tells read once the first bytes arrived.
+func pollingRead(ctx context.Context, conn net.Conn, read chan<- struct{}) {
+	defer conn.Close()
+
+	buf := make([]byte, 64)
+	first := true
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if n > 0 && first {
+			first = false
+			read <- struct{}{}
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// cpuTime returns the CPU time used by the process so far, in nanoseconds.
+func cpuTime(b *testing.B) int64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return usage.Utime.Nano() + usage.Stime.Nano()
+}
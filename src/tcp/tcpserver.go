@@ -18,26 +18,41 @@
 package tcp
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/apache/openserverless-streaming-proxy/stream"
 )
 
+// DefaultHandshakeTimeout is how long a connection can take by default to
+// present its session and token.
+const DefaultHandshakeTimeout = 5 * time.Second
+
+// SocketsServer is the TCP ingress shared by all the streams. Actions
+// connect to it and present the id and token of their session as the first
+// line, so that their output is routed to the HTTP handler waiting for it.
 type SocketsServer struct {
-	ctx            context.Context
-	listener       net.Listener
-	wg             sync.WaitGroup
-	Host           string
-	Port           string
-	StreamDataChan chan []byte
+	ctx      context.Context
+	listener net.Listener
+	wg       sync.WaitGroup
+	done     chan struct{}
+	sessions *stream.Registry
+	Host     string
+	Port     string
+	// HandshakeTimeout is how long a connection can take to present its
+	// session and token before it is closed, 0 for no limit.
+	HandshakeTimeout time.Duration
 }
 
-func SetupTcpServer(ctx context.Context, streamingProxyAddr string) (*SocketsServer, error) {
-	socketServer, err := startTCPServer(ctx, streamingProxyAddr)
+func SetupTcpServer(ctx context.Context, streamingProxyAddr string, port string, sessions *stream.Registry) (*SocketsServer, error) {
+	socketServer, err := startTCPServer(ctx, net.JoinHostPort(streamingProxyAddr, port), sessions)
 	if err != nil {
 		return nil, err
 	}
@@ -54,22 +69,24 @@ func SetupTcpServer(ctx context.Context, streamingProxyAddr string) (*SocketsSer
 	return socketServer, nil
 }
 
-func startTCPServer(ctx context.Context, streamingProxyAddr string) (*SocketsServer, error) {
-	listener, err := net.Listen("tcp", streamingProxyAddr+":0")
+func startTCPServer(ctx context.Context, addr string, sessions *stream.Registry) (*SocketsServer, error) {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, errors.New("Error starting TCP server")
 	}
 
 	s := &SocketsServer{
-		ctx:            ctx,
-		listener:       listener,
-		StreamDataChan: make(chan []byte),
+		ctx:              ctx,
+		listener:         listener,
+		done:             make(chan struct{}),
+		sessions:         sessions,
+		HandshakeTimeout: DefaultHandshakeTimeout,
 	}
 
 	s.wg.Add(1)
 	go s.acceptConnections()
 
-	log.Println("New TCP server listening on:", s.listener.Addr().String())
+	log.Println("TCP server listening on:", s.listener.Addr().String())
 	return s, nil
 }
 
@@ -99,37 +116,83 @@ func (s *SocketsServer) acceptConnections() {
 func (s *SocketsServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	log.Println("New TCP connection accepted!")
-	buf := make([]byte, 2048)
 
-ReadLoop:
-	for {
-		select {
+	// the connection is over when either the server or the session is,
+	// closing it unblocks the pending reads
+	connCtx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	stopClose := context.AfterFunc(connCtx, func() { conn.Close() })
+	defer stopClose()
 
-		case <-s.ctx.Done():
-			return
+	r := bufio.NewReader(conn)
 
-		default:
-			conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	// the connections that do not authenticate in time are dropped, the
+	// claimed ones are bounded by the timeouts of their session
+	if s.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+	sess, err := s.authenticate(r)
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Println("Rejected TCP connection:", err)
+		}
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	stop := context.AfterFunc(sess.StreamContext(), cancel)
+	defer stop()
+
+	mode, err := stream.NegotiateProtocol(r)
+	if err == nil {
+		go writeInput(connCtx, conn, sess, mode)
+		err = stream.Relay(sess, r, mode)
+	}
 
-			for {
-				n, err := conn.Read(buf)
+	// the stream ends when the action closes the connection, unless it
+	// was already ended by a control message
+	switch {
+	case err == stream.ErrEnded || connCtx.Err() != nil:
+	case err == io.EOF:
+		sess.Send(stream.EndMessage(stream.Trailer{}))
+	default:
+		log.Println("Error reading from TCP connection", err)
+		sess.Send(stream.EndMessage(stream.Trailer{Status: "error", Error: err.Error()}))
+	}
+}
 
-				if err != nil {
-					if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-						continue ReadLoop
-					} else if err != io.EOF {
-						log.Println("Error reading from TCP connection", err)
-						return
-					}
-				}
+// authenticate reads the first line of the connection, made of the session
+// id and token separated by a space, and claims the session.
+func (s *SocketsServer) authenticate(r *bufio.Reader) (*stream.Session, error) {
+	line, err := stream.ReadHeaderLine(r)
+	if err != nil {
+		return nil, err
+	}
 
-				if n == 0 {
-					continue ReadLoop
-				}
+	id, token, _ := strings.Cut(line, " ")
+	sess, ok := s.sessions.Get(id)
+	if !ok {
+		return nil, errors.New("unknown session")
+	}
+	if err := sess.Claim(token); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
 
-				s.StreamDataChan <- buf[:n]
+// writeInput writes the messages of the client to the action, in the mode
+// the action chose for its own output.
+func writeInput(ctx context.Context, conn net.Conn, sess *stream.Session, mode stream.Mode) {
+	for {
+		select {
+		case msg := <-sess.Input:
+			if err := stream.WriteMessage(conn, msg, mode); err != nil {
+				if ctx.Err() == nil {
+					log.Println("Error writing to TCP connection", err)
+				}
+				return
 			}
-
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -140,4 +203,11 @@ func (s *SocketsServer) WaitToCleanUp() {
 	s.listener.Close()
 	s.wg.Wait()
 	log.Print("TCP server closed\n\n")
+	close(s.done)
+}
+
+// Done is closed once the server stopped listening and all its
+// connections are closed, after its context is done.
+func (s *SocketsServer) Done() <-chan struct{} {
+	return s.done
 }
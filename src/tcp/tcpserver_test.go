@@ -18,24 +18,49 @@
 package tcp
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
+	"fmt"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/apache/openserverless-streaming-proxy/stream"
 	"github.com/stretchr/testify/require"
 )
 
+func frame(payload string) []byte {
+	buf := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func controlFrame(payload string) []byte {
+	buf := frame(payload)
+	buf[0] |= 0x80
+	return buf
+}
+
+// newTestServer returns a server with a single open session.
+func newTestServer(t *testing.T, ctx context.Context) (*SocketsServer, *stream.Session) {
+	sessions := stream.NewRegistry()
+	sess, err := sessions.Open(ctx)
+	require.NoError(t, err)
+
+	return &SocketsServer{ctx: ctx, sessions: sessions}, sess
+}
+
+func handshake(sess *stream.Session) []byte {
+	return []byte(fmt.Sprintf("%s %s\n", sess.ID, sess.Token))
+}
+
 func TestHandleConnection(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	streamDataChan := make(chan []byte, 10)
-	server := &SocketsServer{
-		ctx:            ctx,
-		StreamDataChan: streamDataChan,
-	}
+	server, sess := newTestServer(t, ctx)
 
 	// Create a pipe to simulate a network connection
 	clientConn, serverConn := net.Pipe()
@@ -51,12 +76,15 @@ func TestHandleConnection(t *testing.T) {
 
 	// Write data to the client connection
 	testData := []byte("test data")
-	clientConn.Write(testData)
+	go func() {
+		clientConn.Write(handshake(sess))
+		clientConn.Write(testData)
+	}()
 
-	// Read data from the streamDataChan
+	// Read data from the session
 	select {
-	case receivedData := <-streamDataChan:
-		require.Equal(t, testData, receivedData)
+	case receivedData := <-sess.Messages:
+		require.Equal(t, string(testData), receivedData.Data)
 	case <-time.After(1 * time.Second):
 		require.Fail(t, "Timeout waiting for data")
 	}
@@ -68,17 +96,15 @@ func TestHandleConnection(t *testing.T) {
 
 func TestHandleConnectionContextCancel(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	streamDataChan := make(chan []byte, 10)
-	server := &SocketsServer{
-		ctx:            ctx,
-		StreamDataChan: streamDataChan,
-	}
+	server, sess := newTestServer(t, context.Background())
 
 	// Create a pipe to simulate a network connection
 	clientConn, serverConn := net.Pipe()
 	defer clientConn.Close()
 	defer serverConn.Close()
 
+	server.ctx = ctx
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -92,30 +118,59 @@ func TestHandleConnectionContextCancel(t *testing.T) {
 
 	// Write data to the client connection after context is cancelled
 	testData := []byte("test data")
-	clientConn.Write(testData)
+	go func() {
+		clientConn.Write(handshake(sess))
+		clientConn.Write(testData)
+	}()
 
-	// Ensure no data is read from the streamDataChan
+	// Ensure no data is read from the session
 	select {
-	case <-streamDataChan:
+	case <-sess.Messages:
 		t.Error("Expected no data, but got some")
 	case <-time.After(100 * time.Millisecond):
 		// Expected case
 	}
 }
+
+func TestHandleConnectionSessionDone(t *testing.T) {
+	sessCtx, sessDone := context.WithCancel(context.Background())
+	server, sess := newTestServer(t, sessCtx)
+	server.ctx = context.Background()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.handleConnection(serverConn)
+	}()
+	clientConn.Write(handshake(sess))
+
+	// the connection is closed when the HTTP handler is done with the session
+	sessDone()
+	wg.Wait()
+
+	_, err := clientConn.Write([]byte("late data"))
+	require.Error(t, err)
+}
+
 func TestSetupTcpServer(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	streamingProxyAddr := "localhost"
-	server, err := SetupTcpServer(ctx, streamingProxyAddr)
+	server, err := SetupTcpServer(ctx, streamingProxyAddr, "0", stream.NewRegistry())
 	require.NoError(t, err)
 	defer server.listener.Close()
 
 	require.NotNil(t, server.ctx)
 	require.NotNil(t, server.listener)
-	require.NotNil(t, server.StreamDataChan)
+	require.NotNil(t, server.sessions)
 	require.NotEmpty(t, server.Host)
 	require.NotEmpty(t, server.Port)
+	require.NotEqual(t, "0", server.Port)
 }
 
 func TestSetupTcpServerInvalidAddress(t *testing.T) {
@@ -123,6 +178,415 @@ func TestSetupTcpServerInvalidAddress(t *testing.T) {
 	defer cancel()
 
 	streamingProxyAddr := "invalid address"
-	_, err := SetupTcpServer(ctx, streamingProxyAddr)
+	_, err := SetupTcpServer(ctx, streamingProxyAddr, "0", stream.NewRegistry())
+	require.Error(t, err)
+}
+
+func TestSetupTcpServerRouting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sessions := stream.NewRegistry()
+	server, err := SetupTcpServer(ctx, "localhost", "0", sessions)
+	require.NoError(t, err)
+
+	// several sessions share the same listener
+	var opened []*stream.Session
+	for i := 0; i < 3; i++ {
+		sess, err := sessions.Open(ctx)
+		require.NoError(t, err)
+		opened = append(opened, sess)
+	}
+
+	for i, sess := range opened {
+		conn, err := net.Dial("tcp", net.JoinHostPort(server.Host, server.Port))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		conn.Write(handshake(sess))
+		conn.Write([]byte(fmt.Sprintf("data for session %d", i)))
+	}
+
+	for i, sess := range opened {
+		select {
+		case receivedData := <-sess.Messages:
+			require.Equal(t, fmt.Sprintf("data for session %d", i), receivedData.Data)
+		case <-time.After(1 * time.Second):
+			require.Fail(t, "Timeout waiting for data")
+		}
+	}
+}
+
+func TestHandleConnectionFramed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newTestServer(t, ctx)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.handleConnection(serverConn)
+	}()
+
+	// Two frames written at once must come out as two messages,
+	// and a frame split across writes as one
+	go func() {
+		clientConn.Write(handshake(sess))
+		clientConn.Write([]byte("OSSTREAM/1 framed\n"))
+		clientConn.Write(append(frame("first"), frame("second")...))
+		third := frame("third frame")
+		clientConn.Write(third[:6])
+		clientConn.Write(third[6:])
+	}()
+
+	for _, expected := range []string{"first", "second", "third frame"} {
+		select {
+		case receivedData := <-sess.Messages:
+			require.Equal(t, expected, receivedData.Data)
+		case <-time.After(1 * time.Second):
+			require.Fail(t, "Timeout waiting for data")
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestHandleConnectionNDJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newTestServer(t, ctx)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.handleConnection(serverConn)
+	}()
+
+	go func() {
+		clientConn.Write(handshake(sess))
+		clientConn.Write([]byte("OSSTREAM/1 ndjson\n"))
+		clientConn.Write([]byte(`{"event": "token", "data": "hel`))
+		clientConn.Write([]byte("lo\"}\n\nnot json\n"))
+		clientConn.Write([]byte(`{"event": "progress", "id": "2", "data": {"percent": 100}}` + "\n"))
+	}()
+
+	expected := []stream.Message{
+		{Event: "token", Data: "hello"},
+		{Event: "progress", ID: "2", Data: `{"percent": 100}`},
+	}
+	for _, msg := range expected {
+		select {
+		case receivedData := <-sess.Messages:
+			require.Equal(t, msg, receivedData)
+		case <-time.After(1 * time.Second):
+			require.Fail(t, "Timeout waiting for data")
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestHandleConnectionEndOfStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   [][]byte
+		expected []stream.Message
+	}{
+		{
+			name:   "Connection closed",
+			writes: [][]byte{[]byte("hello")},
+			expected: []stream.Message{
+				{Data: "hello"},
+				stream.EndMessage(stream.Trailer{}),
+			},
+		},
+		{
+			name:   "EOF text",
+			writes: [][]byte{[]byte("hello"), []byte("EOF")},
+			expected: []stream.Message{
+				{Data: "hello"},
+				{Data: "EOF"},
+				stream.EndMessage(stream.Trailer{}),
+			},
+		},
+		{
+			name: "Control frame",
+			writes: [][]byte{
+				[]byte("OSSTREAM/1 framed\n"),
+				frame("EOF"),
+				controlFrame(`{"control": "end", "status": "success", "result": {"ok": true}}`),
+			},
+			expected: []stream.Message{
+				{Data: "EOF"},
+				stream.EndMessage(stream.Trailer{Status: "success", Result: []byte(`{"ok":true}`)}),
+			},
+		},
+		{
+			name: "Control line",
+			writes: [][]byte{
+				[]byte("OSSTREAM/1 ndjson\n"),
+				[]byte(`{"data": "EOF"}` + "\n"),
+				[]byte(`{"control": "end", "status": "success"}` + "\n"),
+			},
+			expected: []stream.Message{
+				{Data: "EOF"},
+				stream.EndMessage(stream.Trailer{Status: "success"}),
+			},
+		},
+		{
+			name: "Truncated frame",
+			writes: [][]byte{
+				[]byte("OSSTREAM/1 framed\n"),
+				frame("truncated")[:6],
+			},
+			expected: []stream.Message{
+				stream.EndMessage(stream.Trailer{Status: "error", Error: "unexpected EOF"}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			server, sess := newTestServer(t, ctx)
+
+			clientConn, serverConn := net.Pipe()
+			defer serverConn.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				server.handleConnection(serverConn)
+			}()
+
+			go func() {
+				clientConn.Write(handshake(sess))
+				for _, data := range tt.writes {
+					clientConn.Write(data)
+				}
+				clientConn.Close()
+			}()
+
+			for _, msg := range tt.expected {
+				select {
+				case receivedData := <-sess.Messages:
+					require.Equal(t, msg, receivedData)
+				case <-time.After(1 * time.Second):
+					require.Fail(t, "Timeout waiting for data")
+				}
+			}
+
+			wg.Wait()
+		})
+	}
+}
+
+func TestHandleConnectionToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newTestServer(t, ctx)
+
+	connect := func(line string) net.Conn {
+		clientConn, serverConn := net.Pipe()
+		go server.handleConnection(serverConn)
+		go func() {
+			clientConn.Write([]byte(line + "\n"))
+			clientConn.Write([]byte("data from " + line))
+		}()
+		return clientConn
+	}
+
+	// a wrong token or session is rejected before anything is relayed
+	intruder := connect(sess.ID + " guess")
+	defer intruder.Close()
+	lost := connect("unknown " + sess.Token)
+	defer lost.Close()
+
+	// the right token is accepted once
+	valid := sess.ID + " " + sess.Token
+	action := connect(valid)
+	defer action.Close()
+
+	select {
+	case receivedData := <-sess.Messages:
+		require.Equal(t, "data from "+valid, receivedData.Data)
+	case <-time.After(1 * time.Second):
+		require.Fail(t, "Timeout waiting for data")
+	}
+
+	replay := connect(valid)
+	defer replay.Close()
+
+	select {
+	case receivedData := <-sess.Messages:
+		require.Fail(t, "Unexpected data", receivedData.Data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestHandleConnectionInput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newTestServer(t, ctx)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.handleConnection(serverConn)
+	}()
+
+	clientConn.Write(handshake(sess))
+	clientConn.Write([]byte("OSSTREAM/1 ndjson\n"))
+
+	// the client input reaches the action in the mode it chose
+	require.NoError(t, sess.SendInput(context.Background(), stream.Message{Data: "hello action"}))
+
+	reader := bufio.NewReader(clientConn)
+	clientConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, `{"data":"hello action"}`+"\n", line)
+
+	cancel()
+	wg.Wait()
+}
+
+func TestHandleConnectionReadSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sessions := stream.NewRegistry()
+	sessions.ReadSize = 4
+	sess, err := sessions.Open(ctx)
+	require.NoError(t, err)
+	server := &SocketsServer{ctx: ctx, sessions: sessions}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.handleConnection(serverConn)
+
+	go func() {
+		clientConn.Write(handshake(sess))
+		clientConn.Write([]byte("abcdefghij"))
+	}()
+
+	// every read is cut to the read size
+	for _, expected := range []string{"abcd", "efgh", "ij"} {
+		select {
+		case msg := <-sess.Messages:
+			require.Equal(t, expected, msg.Data)
+		case <-time.After(1 * time.Second):
+			require.Fail(t, "Timeout waiting for data")
+		}
+	}
+}
+
+func TestHandleConnectionIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sessions := stream.NewRegistry()
+	sessions.Timeouts.Idle = 50 * time.Millisecond
+	sess, err := sessions.Open(ctx)
+	require.NoError(t, err)
+	server := &SocketsServer{ctx: ctx, sessions: sessions}
+	go sess.Record()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.handleConnection(serverConn)
+	}()
+	clientConn.Write(handshake(sess))
+
+	// the silent action is disconnected, while the session is kept for
+	// its clients to read the timeout
+	wg.Wait()
+	_, err = clientConn.Write([]byte("late data"))
 	require.Error(t, err)
+	require.NoError(t, sess.Context().Err())
+	require.True(t, sess.Replay.Ended())
+}
+
+func TestHandleConnectionHandshakeTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, sess := newTestServer(t, ctx)
+	server.HandshakeTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		handshake []byte
+	}{
+		{name: "Idle client"},
+		{name: "Partial handshake", handshake: []byte(sess.ID)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				server.handleConnection(serverConn)
+			}()
+			if tt.handshake != nil {
+				clientConn.Write(tt.handshake)
+			}
+
+			// the client is dropped without claiming the session
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				require.Fail(t, "Timeout waiting for the connection to be closed")
+			}
+			_, err := clientConn.Write([]byte("late data"))
+			require.Error(t, err)
+		})
+	}
+
+	// the deadline is cleared once the session is claimed
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.handleConnection(serverConn)
+	clientConn.Write(handshake(sess))
+	time.Sleep(100 * time.Millisecond)
+	clientConn.Write([]byte("hello"))
+
+	select {
+	case msg := <-sess.Messages:
+		require.Equal(t, stream.Message{Data: "hello"}, msg)
+	case <-time.After(time.Second):
+		require.Fail(t, "Timeout waiting for data")
+	}
 }
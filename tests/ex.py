@@ -30,15 +30,17 @@ example_data = [
 def main(args):
 
     streamer = (args.get("STREAM_HOST"), args.get("STREAM_PORT"))
+    session = (args.get("STREAM_SESSION"), args.get("STREAM_TOKEN"))
     
-    if not streamer[0] or not streamer[1]:
-        return {"body": "please provide a STREAM_HOST and STREAM_PORT"}
+    if not streamer[0] or not streamer[1] or not session[0] or not session[1]:
+        return {"body": "please provide a STREAM_HOST, STREAM_PORT, STREAM_SESSION and STREAM_TOKEN"}
     
     print(f"streamer: {streamer}")
 
     # # invoke a call to a streaming api server like OpenAI
     with socket.socket(socket.AF_INET, socket.SOCK_STREAM) as s:
         s.connect((streamer[0], int(streamer[1])))
+        s.sendall(f"{session[0]} {session[1]}\n".encode())
 
         for ex in example_data:
             time.sleep(1)
@@ -48,7 +50,6 @@ def main(args):
                 s.sendall(ex.encode())
 
         print("done sending. closing connection")
-        s.sendall("EOF".encode())
         s.close()
     
     return {"body": "done"}
\ No newline at end of file
@@ -0,0 +1,64 @@
+# Licensed to the Apache Software Foundation (ASF) under one
+# or more contributor license agreements.  See the NOTICE file
+# distributed with this work for additional information
+# regarding copyright ownership.  The ASF licenses this file
+# to you under the Apache License, Version 2.0 (the
+# "License"); you may not use this file except in compliance
+# with the License.  You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing,
+# software distributed under the License is distributed on an
+# "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+# KIND, either express or implied.  See the License for the
+# specific language governing permissions and limitations
+# under the License.
+
+import json
+import socket
+import struct
+import time
+
+example_data = [
+    "Hello, World!",
+    "This is a test",
+    "from an HTTP SSE request",
+    "Through an openwhisk action",
+    "To a socket server",
+    "Back to the HTTP client",
+]
+
+def send_frame(s, data, control=False):
+    payload = data.encode()
+    header = len(payload) | (0x80000000 if control else 0)
+    s.sendall(struct.pack(">I", header) + payload)
+
+def main(args):
+
+    streamer = (args.get("STREAM_HOST"), args.get("STREAM_PORT"))
+    session = (args.get("STREAM_SESSION"), args.get("STREAM_TOKEN"))
+    
+    if not streamer[0] or not streamer[1] or not session[0] or not session[1]:
+        return {"body": "please provide a STREAM_HOST, STREAM_PORT, STREAM_SESSION and STREAM_TOKEN"}
+    
+    print(f"streamer: {streamer}")
+
+    with socket.socket(socket.AF_INET, socket.SOCK_STREAM) as s:
+        s.connect((streamer[0], int(streamer[1])))
+        s.sendall(f"{session[0]} {session[1]}\n".encode())
+
+        # ask for one event per frame
+        s.sendall(b"OSSTREAM/1 framed\n")
+
+        for ex in example_data:
+            time.sleep(1)
+            print(f"sending: {ex}")
+            send_frame(s, ex)
+
+        print("done sending. closing connection")
+        end = {"control": "end", "status": "success", "result": {"sent": len(example_data)}}
+        send_frame(s, json.dumps(end), control=True)
+        s.close()
+    
+    return {"body": "done"}